@@ -1,18 +1,35 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/elidotexe/backend_byteurl/internal/auth"
 	"github.com/elidotexe/backend_byteurl/internal/config"
 	"github.com/elidotexe/backend_byteurl/internal/driver"
 	"github.com/elidotexe/backend_byteurl/internal/handlers"
+	"github.com/elidotexe/backend_byteurl/internal/jobs"
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/oauth"
+	"github.com/elidotexe/backend_byteurl/internal/passwords"
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+	"github.com/elidotexe/backend_byteurl/internal/repository/dbrepo"
 	"github.com/elidotexe/backend_byteurl/internal/routes"
+	"github.com/elidotexe/backend_byteurl/internal/shortcode"
 )
 
+// shutdownTimeout is how long requests in flight and background work get to
+// finish on shutdown
+const shutdownTimeout = time.Second * 10
+
 var app config.AppConfig
 var authInstance *auth.Auth
 
@@ -27,16 +44,34 @@ func main() {
 		config.DB_HOST, config.DB_PORT, config.DB_NAME, config.DB_USER, config.DB_PASSWORD)
 
 	authInstance = &auth.Auth{
-		Issuer:       config.JWT_ISSUER,
-		Audience:     config.JWT_AUDIENCE,
-		Secret:       config.JWT_SECRET,
-		TokenExpiry:  time.Hour * 24,
-		CookiePath:   "/",
-		CookieName:   "__Host-refresh_token",
-		CookieDomain: config.COOKIE_DOMAIN,
+		Issuer:        config.JWT_ISSUER,
+		Audience:      config.JWT_AUDIENCE,
+		Secret:        config.JWT_SECRET,
+		TokenExpiry:   time.Minute * 15,
+		RefreshExpiry: time.Hour * 24 * 30,
+		CookiePath:    "/",
+		CookieName:    "__Host-refresh_token",
+		CookieDomain:  config.COOKIE_DOMAIN,
 	}
 
-	_, err = run()
+	if config.JWT_SIGNING_KEY_FILE != "" {
+		var verificationKeyFiles []string
+		for _, path := range strings.Split(config.JWT_VERIFICATION_KEY_FILES, ",") {
+			if strings.TrimSpace(path) != "" {
+				verificationKeyFiles = append(verificationKeyFiles, strings.TrimSpace(path))
+			}
+		}
+
+		err = authInstance.LoadKeys(config.JWT_SIGNING_KEY_FILE, verificationKeyFiles)
+		if err != nil {
+			log.Fatalf("Error loading JWT keys: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	_, err = run(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,14 +81,43 @@ func main() {
 		Handler: routes.SetupRoutes(&app, authInstance),
 	}
 
-	log.Println("Starting server on port", app.PORT)
-	err = src.ListenAndServe()
-	if err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("Starting server on port", app.PORT)
+		serverErr <- src.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serverErr:
 		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = src.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Failed to shut down server: %v\n", err)
+	}
+
+	// Bulk uploads and emails that were accepted should not be cut off. Bulk
+	// jobs that take longer stop saving progress and are marked as failed later on.
+	err = handlers.Repo.WaitForBackground(shutdownCtx)
+	if err != nil {
+		log.Printf("Failed to wait for background work: %v\n", err)
+	}
+
+	// Clicks counted by the last requests are still in the buffer
+	err = handlers.Repo.Clicks.Flush()
+	if err != nil {
+		log.Printf("Failed to flush clicks: %v\n", err)
 	}
 }
 
-func run() (*driver.DB, error) {
+func run(ctx context.Context) (*driver.DB, error) {
 	log.Println("Connecting to database...")
 	db, err := driver.ConnectGORM(app.DSN)
 	if err != nil {
@@ -63,8 +127,130 @@ func run() (*driver.DB, error) {
 
 	log.Println("Connected to database!")
 
-	repo := handlers.NewRepo(&app, db, authInstance)
+	authInstance.APITokens = dbrepo.NewPostgresRepo(db.Gorm, &app)
+	authInstance.Sessions = dbrepo.NewPostgresRepo(db.Gorm, &app)
+
+	switch app.TOKEN_REVOCATION_STORE {
+	case "memory":
+		authInstance.Revocations = dbrepo.NewMemoryRevocationRepo()
+	default:
+		authInstance.Revocations = dbrepo.NewPostgresRepo(db.Gorm, &app)
+	}
+
+	switch app.LOGIN_ATTEMPT_STORE {
+	case "memory":
+		authInstance.LoginAttempts = dbrepo.NewMemoryLoginAttemptRepo()
+	default:
+		authInstance.LoginAttempts = dbrepo.NewPostgresRepo(db.Gorm, &app)
+	}
+
+	m, err := mailer.New(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := oauth.NewProviders(context.Background(), &app)
+
+	policy, err := passwordPolicy(&app)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := shortCodeGenerator(&app, dbrepo.NewPostgresRepo(db.Gorm, &app))
+	if err != nil {
+		return nil, err
+	}
+
+	repo := handlers.NewRepo(&app, db, authInstance, m, providers, policy, codes)
 	handlers.NewHandlers(repo)
 
+	if app.BOOTSTRAP_ADMIN_EMAIL != "" {
+		err = bootstrapAdmin(repo.DB, app.BOOTSTRAP_ADMIN_EMAIL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go jobs.Every(ctx, "purge deleted users", time.Hour, jobs.PurgeDeletedUsers(repo.DB, app.AccountDeletionGracePeriod()))
+	go jobs.Every(ctx, "mark finished links", time.Minute, jobs.MarkFinishedLinks(repo.DB))
+	go jobs.Every(ctx, "flush clicks", app.ClickFlushInterval(), jobs.FlushClicks(repo.Clicks))
+	go jobs.Every(ctx, "fail stale bulk jobs", time.Minute*5, jobs.FailStaleBulkJobs(repo.DB, time.Minute*10))
+
 	return db, nil
 }
+
+// bootstrapAdmin gives the admin role to the user with the given email, if
+// they do not have it yet
+func bootstrapAdmin(db repository.DatabaseRepo, email string) error {
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		log.Printf("Bootstrap admin %s does not exist yet\n", email)
+		return nil
+	}
+	if user.Role == auth.RoleAdmin {
+		return nil
+	}
+
+	err = db.UpdateUserRole(user.ID, auth.RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Promoted %s to admin\n", email)
+
+	return db.InsertAuditEvent(&models.AuditEvent{
+		UserID:    user.ID,
+		ActorID:   user.ID,
+		Action:    models.AuditRoleChanged,
+		Details:   fmt.Sprintf("%s -> %s (bootstrap)", user.Role, auth.RoleAdmin),
+		CreatedAt: time.Now(),
+	})
+}
+
+// passwordPolicy builds the password policy from the configuration
+func passwordPolicy(app *config.AppConfig) (*passwords.Policy, error) {
+	policy := &passwords.Policy{
+		MinLength:       app.PASSWORD_MIN_LENGTH,
+		MinEntropy:      app.PASSWORD_MIN_ENTROPY,
+		AllowCommon:     app.PASSWORD_ALLOW_COMMON,
+		BreachThreshold: app.BREACHED_PASSWORDS_THRESHOLD,
+	}
+
+	if policy.MinLength <= 0 {
+		policy.MinLength = 8
+	}
+
+	if policy.MinEntropy <= 0 {
+		policy.MinEntropy = 40
+	}
+
+	if app.BREACHED_PASSWORDS_PATH != "" {
+		breached, err := passwords.LoadBreached(app.BREACHED_PASSWORDS_PATH)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load breached passwords: %w", err)
+		}
+
+		policy.Breached = breached
+	}
+
+	return policy, nil
+}
+
+// shortCodeGenerator builds the short code generator from the configuration
+func shortCodeGenerator(app *config.AppConfig, db repository.DatabaseRepo) (shortcode.Generator, error) {
+	codes, err := shortcode.New(shortcode.Options{
+		Kind:     app.SHORT_CODE_GENERATOR,
+		Length:   app.SHORT_CODE_LENGTH,
+		Alphabet: app.SHORT_CODE_ALPHABET,
+		Secret:   app.SHORT_CODE_SECRET,
+		Counter:  db.NextShortCodeCounter,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot set up short codes: %w", err)
+	}
+
+	return codes, nil
+}
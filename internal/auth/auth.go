@@ -7,54 +7,112 @@ import (
 	"strings"
 	"time"
 
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
 	"github.com/golang-jwt/jwt/v4"
 )
 
+const mfaTokenExpiry = time.Minute * 5
+
+// sessionTouchInterval limits how often the last seen time of a session is written
+const sessionTouchInterval = time.Minute
+
 type Auth struct {
-	Issuer       string
-	Audience     string
-	Secret       string
-	TokenExpiry  time.Duration
-	CookieDomain string
-	CookiePath   string
-	CookieName   string
+	Issuer        string
+	Audience      string
+	Secret        string
+	TokenExpiry   time.Duration
+	RefreshExpiry time.Duration
+	CookieDomain  string
+	CookiePath    string
+	CookieName    string
+	Revocations   repository.RevocationRepo
+	APITokens     repository.APITokenRepo
+	LoginAttempts repository.LoginAttemptRepo
+	Sessions      repository.SessionRepo
+
+	// SigningKey switches signing from HS256 with Secret to an asymmetric key.
+	// VerificationKeys holds every key whose tokens are still accepted.
+	SigningKey       *Key
+	VerificationKeys []*Key
 }
 
 type JWTUser struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Token string `json:"token"`
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Role          string `json:"role"`
+	Token         string `json:"token"`
+}
+
+type TokenPairs struct {
+	Token        string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type Claims struct {
+	Type      string            `json:"typ,omitempty"`
+	Data      map[string]string `json:"dat,omitempty"`
+	Scopes    []string          `json:"scopes,omitempty"`
+	Role      string            `json:"role,omitempty"`
+	SessionID string            `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func (j *Auth) GenerateTokenPair(user *JWTUser) (string, error) {
+const (
+	// TokenTypeAccess marks tokens that grant access to the API
+	TokenTypeAccess = "JWT"
+	// TokenTypeMFA marks the intermediate token issued between the password
+	// and the second factor of a login
+	TokenTypeMFA = "mfa"
+)
+
+// GenerateTokenPair returns a short-lived signed access token for the given
+// session and an opaque refresh token. Only the hash of the refresh token
+// should ever be stored.
+func (j *Auth) GenerateTokenPair(user *JWTUser, sessionID string) (TokenPairs, error) {
 	// Create a token
 	token := jwt.New(jwt.SigningMethodHS256)
 
+	// Give every token an id so that it can be revoked on its own
+	jti, err := utils.GenerateSecureToken(16)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
 	// Set the claims
 	claims := token.Claims.(jwt.MapClaims)
+	claims["jti"] = jti
 	claims["name"] = user.Email
 	claims["sub"] = fmt.Sprint(user.ID)
 	claims["aud"] = j.Audience
 	claims["iss"] = j.Issuer
 	claims["iat"] = time.Now().UTC().Unix()
-	claims["typ"] = "JWT"
+	claims["typ"] = TokenTypeAccess
+	claims["role"] = user.Role
+	claims["sid"] = sessionID
 
 	// Set the expiry for JWT
 	claims["exp"] = time.Now().UTC().Add(j.TokenExpiry).Unix()
 
 	// Create a signed token
-	signedAccessToken, err := token.SignedString([]byte(j.Secret))
+	signedAccessToken, err := j.signToken(token)
 	if err != nil {
-		return "", err
+		return TokenPairs{}, err
+	}
+
+	// Create an opaque refresh token
+	refreshToken, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		return TokenPairs{}, err
 	}
 
 	// Return TokenPairs
-	return signedAccessToken, nil
+	return TokenPairs{
+		Token:        signedAccessToken,
+		RefreshToken: refreshToken,
+	}, nil
 }
 
 func (j *Auth) GetRefreshCookie(token string) *http.Cookie {
@@ -62,8 +120,22 @@ func (j *Auth) GetRefreshCookie(token string) *http.Cookie {
 		Name:     j.CookieName,
 		Path:     j.CookiePath,
 		Value:    token,
-		Expires:  time.Now().Add(j.TokenExpiry),
-		MaxAge:   int(j.TokenExpiry.Seconds()),
+		Expires:  time.Now().Add(j.RefreshExpiry),
+		MaxAge:   int(j.RefreshExpiry.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+		Domain:   j.CookieDomain,
+		HttpOnly: true,
+		Secure:   true,
+	}
+}
+
+func (j *Auth) GetExpiredRefreshCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     j.CookieName,
+		Path:     j.CookiePath,
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
 		SameSite: http.SameSiteStrictMode,
 		Domain:   j.CookieDomain,
 		HttpOnly: true,
@@ -91,9 +163,160 @@ func (j *Auth) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Reques
 
 	token := headerParts[1]
 
+	if IsAPIToken(token) {
+		claims, err := j.verifyAPIToken(token)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return token, claims, nil
+	}
+
+	claims, err := j.VerifyToken(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, claims, nil
+}
+
+// VerifyToken validates a signed access token and returns its claims
+func (j *Auth) VerifyToken(token string) (*Claims, error) {
+	claims := &Claims{}
+
+	err := j.parseToken(token, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != TokenTypeAccess {
+		return nil, errors.New("invalid token type")
+	}
+
+	if j.Revocations != nil {
+		userID, err := claims.UserID()
+		if err != nil {
+			return nil, errors.New("invalid token")
+		}
+
+		var issuedAt time.Time
+		if claims.IssuedAt != nil {
+			issuedAt = claims.IssuedAt.Time
+		}
+
+		revoked, err := j.Revocations.IsTokenRevoked(claims.ID, userID, issuedAt)
+		if err != nil {
+			return nil, errors.New("failed to check token revocation")
+		}
+		if revoked {
+			return nil, errors.New("revoked token")
+		}
+	}
+
+	if j.Sessions != nil && claims.SessionID != "" {
+		err = j.checkSession(claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return claims, nil
+}
+
+// checkSession rejects tokens of sessions that were revoked and keeps track
+// of when the session was last used
+func (j *Auth) checkSession(sessionID string) error {
+	session, err := j.Sessions.GetSession(sessionID)
+	if err != nil {
+		return errors.New("failed to check session")
+	}
+	if session == nil || session.RevokedAt != nil {
+		return errors.New("revoked session")
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		err = j.Sessions.TouchSession(sessionID, now)
+		if err != nil {
+			return errors.New("failed to update session")
+		}
+	}
+
+	return nil
+}
+
+// GenerateMFAToken returns a short-lived token proving that the user has
+// already passed the password step of a two-step login
+func (j *Auth) GenerateMFAToken(userID int) (string, error) {
+	return j.GenerateSignedToken(TokenTypeMFA, fmt.Sprint(userID), nil, mfaTokenExpiry)
+}
+
+// VerifyMFAToken validates a token created by GenerateMFAToken and returns the user id
+func (j *Auth) VerifyMFAToken(token string) (int, error) {
+	claims, err := j.VerifySignedToken(token, TokenTypeMFA)
+	if err != nil {
+		return 0, err
+	}
+
+	return claims.UserID()
+}
+
+// GenerateSignedToken returns a short-lived signed token of the given type.
+// It is used for values that have to travel through the client, such as the
+// second step of a login, without being stored on the server.
+func (j *Auth) GenerateSignedToken(tokenType, subject string, data map[string]string, expiry time.Duration) (string, error) {
+	claims := Claims{
+		Type: tokenType,
+		Data: data,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{j.Audience},
+			Issuer:    j.Issuer,
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiry)),
+		},
+	}
+
+	return j.signToken(jwt.NewWithClaims(jwt.SigningMethodHS256, claims))
+}
+
+// VerifySignedToken validates a token created by GenerateSignedToken and
+// makes sure that it has the expected type
+func (j *Auth) VerifySignedToken(token, tokenType string) (*Claims, error) {
 	claims := &Claims{}
 
+	err := j.parseToken(token, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != tokenType {
+		return nil, errors.New("invalid token type")
+	}
+
+	return claims, nil
+}
+
+func (j *Auth) signToken(token *jwt.Token) (string, error) {
+	if j.SigningKey != nil {
+		token.Method = j.SigningKey.Method
+		token.Header["alg"] = j.SigningKey.Method.Alg()
+		token.Header["kid"] = j.SigningKey.ID
+
+		return token.SignedString(j.SigningKey.Private)
+	}
+
+	return token.SignedString([]byte(j.Secret))
+}
+
+// parseToken checks the signature, expiry, issuer and audience of a token and
+// fills claims
+func (j *Auth) parseToken(token string, claims *Claims) error {
 	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if j.SigningKey != nil {
+			return j.verificationKey(token)
+		}
+
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
@@ -103,15 +326,19 @@ func (j *Auth) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Reques
 
 	if err != nil {
 		if strings.Contains(err.Error(), "token is expired by") {
-			return "", nil, errors.New("expired token")
+			return errors.New("expired token")
 		}
 
-		return "", nil, errors.New("invalid token")
+		return errors.New("invalid token")
 	}
 
 	if claims.Issuer != j.Issuer {
-		return "", nil, fmt.Errorf("invalid issuer")
+		return fmt.Errorf("invalid issuer")
 	}
 
-	return token, claims, nil
+	if !claims.VerifyAudience(j.Audience, true) {
+		return fmt.Errorf("invalid audience")
+	}
+
+	return nil
 }
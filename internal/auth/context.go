@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// ContextWithClaims returns a copy of ctx that carries the authenticated claims
+func ContextWithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// ClaimsFromContext returns the claims stored by RequireAuth, if any
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok && claims != nil
+}
+
+// UserID returns the subject of the claims as a user id
+func (c *Claims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Key is an asymmetric key used to sign or verify tokens. Verification-only
+// keys have no private key, which is how retired keys stay valid for tokens
+// that were signed before a rotation.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.PrivateKey
+	Public  crypto.PublicKey
+}
+
+// JWK is the JSON Web Key representation of a public key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// LoadKeyFile reads an RSA or Ed25519 key from a PEM file. Private keys may be
+// PKCS #1 or PKCS #8, public keys must be PKIX.
+func LoadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+
+	var private crypto.PrivateKey
+	var public crypto.PublicKey
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s has unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	if private != nil {
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a signing key", path)
+		}
+		public = signer.Public()
+	}
+
+	return newKey(private, public)
+}
+
+func newKey(private crypto.PrivateKey, public crypto.PublicKey) (*Key, error) {
+	key := &Key{
+		Private: private,
+		Public:  public,
+	}
+
+	switch public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+
+	thumbprint, err := key.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = thumbprint
+
+	return key, nil
+}
+
+// JWK returns the public part of the key as a JSON Web Key
+func (k *Key) JWK() JWK {
+	jwk := JWK{
+		Kid: k.ID,
+		Use: "sig",
+		Alg: k.Method.Alg(),
+	}
+
+	switch public := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+
+	return jwk
+}
+
+// thumbprint returns the RFC 7638 JWK thumbprint, which makes a stable key id
+func (k *Key) thumbprint() (string, error) {
+	jwk := k.JWK()
+
+	var canonical string
+	switch jwk.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Crv, jwk.X)
+	default:
+		return "", errors.New("unsupported key type")
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// JWKS returns every key that tokens may be verified with
+func (j *Auth) JWKS() []JWK {
+	keys := make([]JWK, 0, len(j.VerificationKeys))
+	for _, key := range j.VerificationKeys {
+		keys = append(keys, key.JWK())
+	}
+
+	return keys
+}
+
+// LoadKeys sets the signing key and the keys that are accepted for
+// verification. The signing key is always accepted, additional keys are
+// usually the ones that were rotated out.
+func (j *Auth) LoadKeys(signingKeyFile string, verificationKeyFiles []string) error {
+	signingKey, err := LoadKeyFile(signingKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if signingKey.Private == nil {
+		return fmt.Errorf("%s does not contain a private key", signingKeyFile)
+	}
+
+	j.SigningKey = signingKey
+	j.VerificationKeys = []*Key{signingKey}
+
+	for _, path := range verificationKeyFiles {
+		key, err := LoadKeyFile(path)
+		if err != nil {
+			return err
+		}
+
+		if key.ID != signingKey.ID {
+			j.VerificationKeys = append(j.VerificationKeys, key)
+		}
+	}
+
+	return nil
+}
+
+// verificationKey returns the key that signed a token, based on its kid header
+func (j *Auth) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	for _, key := range j.VerificationKeys {
+		if key.ID != kid {
+			continue
+		}
+
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key.Public, nil
+	}
+
+	return nil, fmt.Errorf("unknown key id: %s", kid)
+}
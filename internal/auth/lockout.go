@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+)
+
+// Brute-force protection for logins. Every failure is counted per account and
+// per client IP. After a few free attempts each further attempt has to wait
+// exponentially longer, and too many failures lock the key for a while.
+const (
+	loginFreeAttempts      = 3
+	loginFreeIPAttempts    = 20
+	loginBaseDelay         = time.Second
+	loginMaxDelay          = time.Minute * 5
+	loginFailureWindow     = time.Minute * 30
+	maxAccountLoginFailure = 10
+	maxIPLoginFailures     = 50
+	loginLockoutDuration   = time.Minute * 30
+)
+
+// AccountLoginKey returns the attempt key for an account
+func AccountLoginKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// IPLoginKey returns the attempt key for a client address
+func IPLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// LinkUnlockKey returns the attempt key for unlocking a protected link from a
+// client address. Failures are not counted per link alone, otherwise anybody
+// could lock a link for all of its visitors.
+func LinkUnlockKey(linkID int, ip string) string {
+	return fmt.Sprintf("link:%d:%s", linkID, ip)
+}
+
+// IPUnlockKey returns the attempt key for unlocking any link from a client address
+func IPUnlockKey(ip string) string {
+	return "ip:unlock:" + ip
+}
+
+// LoginRetryAfter returns how long the caller has to wait before another
+// login attempt is allowed for any of the keys. Zero means it may go ahead.
+func (j *Auth) LoginRetryAfter(keys ...string) (time.Duration, error) {
+	if j.LoginAttempts == nil {
+		return 0, nil
+	}
+
+	var wait time.Duration
+
+	for _, key := range keys {
+		attempt, err := j.LoginAttempts.GetLoginAttempt(key)
+		if err != nil {
+			return 0, err
+		}
+		if attempt == nil {
+			continue
+		}
+
+		freeAttempts := loginFreeAttempts
+		if strings.HasPrefix(key, "ip:") {
+			freeAttempts = loginFreeIPAttempts
+		}
+
+		if d := loginDelay(attempt, freeAttempts, time.Now()); d > wait {
+			wait = d
+		}
+	}
+
+	return wait, nil
+}
+
+// LoginFailed records a failed attempt for the account and the client. It
+// returns true when this failure locked the account.
+func (j *Auth) LoginFailed(accountKey, ipKey string) (bool, error) {
+	if j.LoginAttempts == nil {
+		return false, nil
+	}
+
+	now := time.Now()
+
+	attempt, err := j.LoginAttempts.RecordLoginFailure(ipKey, now, now.Add(-loginFailureWindow))
+	if err != nil {
+		return false, err
+	}
+
+	if attempt.Failures >= maxIPLoginFailures && attempt.LockedUntil == nil {
+		err = j.LoginAttempts.LockLogin(ipKey, now.Add(loginLockoutDuration))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	attempt, err = j.LoginAttempts.RecordLoginFailure(accountKey, now, now.Add(-loginFailureWindow))
+	if err != nil {
+		return false, err
+	}
+
+	if attempt.Failures >= maxAccountLoginFailure && attempt.LockedUntil == nil {
+		err = j.LoginAttempts.LockLogin(accountKey, now.Add(loginLockoutDuration))
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// ResetLoginFailures clears the failures and lockout of an account. Client
+// failures are kept so that one valid account cannot be used to reset the
+// counter of an IP.
+func (j *Auth) ResetLoginFailures(accountKey string) error {
+	if j.LoginAttempts == nil {
+		return nil
+	}
+
+	return j.LoginAttempts.ResetLoginAttempts(accountKey)
+}
+
+// loginDelay returns the remaining wait for a single attempt record
+func loginDelay(attempt *models.LoginAttempt, freeAttempts int, now time.Time) time.Duration {
+	if attempt.LockedUntil != nil && now.Before(*attempt.LockedUntil) {
+		return attempt.LockedUntil.Sub(now)
+	}
+
+	if now.Sub(attempt.LastFailedAt) > loginFailureWindow || attempt.Failures <= freeAttempts {
+		return 0
+	}
+
+	delay := loginBaseDelay << uint(attempt.Failures-freeAttempts-1)
+	if delay > loginMaxDelay || delay <= 0 {
+		delay = loginMaxDelay
+	}
+
+	if wait := attempt.LastFailedAt.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+
+	return 0
+}
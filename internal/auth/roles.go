@@ -0,0 +1,60 @@
+package auth
+
+// Roles that can be given to a user
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Permissions that are granted through roles
+const (
+	PermissionUsersRead     = "users:read"
+	PermissionUsersSuspend  = "users:suspend"
+	PermissionLinksModerate = "links:moderate"
+	PermissionRolesManage   = "roles:manage"
+	PermissionMetricsRead   = "metrics:read"
+)
+
+var rolePermissions = map[string][]string{
+	RoleUser: {},
+	RoleSupport: {
+		PermissionUsersRead,
+		PermissionUsersSuspend,
+		PermissionLinksModerate,
+	},
+	RoleAdmin: {
+		PermissionUsersRead,
+		PermissionUsersSuspend,
+		PermissionLinksModerate,
+		PermissionRolesManage,
+		PermissionMetricsRead,
+	},
+}
+
+// IsValidRole reports whether role can be given to a user
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleHasPermission reports whether the role grants the permission
+func RoleHasPermission(role, permission string) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPermission reports whether the claims grant the permission. Only access
+// tokens from a login carry a role, API tokens never have permissions.
+func (c *Claims) HasPermission(permission string) bool {
+	if c.Type != TokenTypeAccess {
+		return false
+	}
+
+	return RoleHasPermission(c.Role, permission)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of RFC 6238 Appendix B, "12345678901234567890"
+// encoded as base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The test vectors of RFC 6238 Appendix B for SHA1. The RFC uses 8 digits, we
+// use 6, which are the last 6 digits of the same value.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		code, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode at %d: %v", v.unix, err)
+		}
+
+		if code != v.code {
+			t.Errorf("TOTPCode at %d = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestTOTPCodeLowercaseSecret(t *testing.T) {
+	code, err := TOTPCode("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", TOTPStep(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != "287082" {
+		t.Errorf("TOTPCode = %s, want 287082", code)
+	}
+}
+
+func TestTOTPCodeInvalidSecret(t *testing.T) {
+	_, err := TOTPCode("not base32!", 1)
+	if err == nil {
+		t.Error("TOTPCode accepted an invalid secret")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+
+		step, ok := ValidateTOTP(rfc6238Secret, v.code, now)
+		if !ok {
+			t.Errorf("ValidateTOTP rejected %s at %d", v.code, v.unix)
+			continue
+		}
+
+		if step != TOTPStep(now) {
+			t.Errorf("ValidateTOTP at %d matched step %d, want %d", v.unix, step, TOTPStep(now))
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := TOTPStep(now)
+
+	tests := []struct {
+		name  string
+		step  int64
+		valid bool
+	}{
+		{"two steps behind", current - 2, false},
+		{"one step behind", current - 1, true},
+		{"current step", current, true},
+		{"one step ahead", current + 1, true},
+		{"two steps ahead", current + 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := TOTPCode(rfc6238Secret, tt.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok := ValidateTOTP(rfc6238Secret, code, now)
+			if ok != tt.valid {
+				t.Fatalf("ValidateTOTP = %v, want %v", ok, tt.valid)
+			}
+
+			if ok && step != tt.step {
+				t.Errorf("ValidateTOTP matched step %d, want %d", step, tt.step)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPInput(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"spaces are ignored", "287 082", true},
+		{"wrong code", "287083", false},
+		{"too short", "28708", false},
+		{"too long", "2870820", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := ValidateTOTP(rfc6238Secret, tt.code, now)
+			if ok != tt.valid {
+				t.Errorf("ValidateTOTP(%q) = %v, want %v", tt.code, ok, tt.valid)
+			}
+		})
+	}
+}
+
+// A code stays valid for a while because of the skew, so callers only accept
+// a step that is later than the last one used. ValidateTOTP has to report the
+// step the code belongs to, not the current one, for that to work.
+func TestValidateTOTPReplay(t *testing.T) {
+	issued := time.Unix(1234567890, 0)
+
+	code, err := TOTPCode(rfc6238Secret, TOTPStep(issued))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastStep int64
+	use := func(now time.Time) bool {
+		step, ok := ValidateTOTP(rfc6238Secret, code, now)
+		if !ok || step <= lastStep {
+			return false
+		}
+
+		lastStep = step
+		return true
+	}
+
+	if !use(issued) {
+		t.Fatal("first use of the code was rejected")
+	}
+
+	if use(issued) {
+		t.Error("the same code was accepted twice in the same step")
+	}
+
+	if use(issued.Add(time.Second * totpPeriod)) {
+		t.Error("the same code was accepted again in the next step")
+	}
+
+	next, err := TOTPCode(rfc6238Secret, TOTPStep(issued)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code = next
+	if !use(issued.Add(time.Second * totpPeriod)) {
+		t.Error("the code of the next step was rejected")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"abcde-fghij", "abcde-fghij"},
+		{" ABCDE-FGHIJ ", "abcde-fghij"},
+		{"abcdefghij", "abcde-fghij"},
+		{"abcde fghij", "abcde-fghij"},
+		{"abc", "abc"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeRecoveryCode(tt.in); got != tt.want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
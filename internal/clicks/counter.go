@@ -0,0 +1,57 @@
+package clicks
+
+import (
+	"sync"
+)
+
+// FlushFunc stores batched clicks, keyed by link id
+type FlushFunc func(counts map[int]int) error
+
+// Counter adds up clicks in memory so that busy links cost one update per
+// flush instead of one per click
+type Counter struct {
+	mu      sync.Mutex
+	pending map[int]int
+	flush   FlushFunc
+}
+
+func NewCounter(flush FlushFunc) *Counter {
+	return &Counter{
+		pending: make(map[int]int),
+		flush:   flush,
+	}
+}
+
+// Add counts n clicks on a link until the next flush
+func (c *Counter) Add(linkID, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[linkID] += n
+}
+
+// Flush stores the clicks counted since the last flush. When that fails they
+// are kept and stored with the next flush.
+func (c *Counter) Flush() error {
+	c.mu.Lock()
+	counts := c.pending
+	c.pending = make(map[int]int)
+	c.mu.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := c.flush(counts)
+	if err != nil {
+		c.mu.Lock()
+		for linkID, n := range counts {
+			c.pending[linkID] += n
+		}
+		c.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
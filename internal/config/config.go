@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -17,6 +19,88 @@ type AppConfig struct {
 	JWT_SECRET    string `mapstructure:"JWT_SECRET"`
 	JWT_ISSUER    string `mapstructure:"JWT_ISSUER"`
 	JWT_AUDIENCE  string `mapstructure:"JWT_AUDIENCE"`
+
+	// JWT_SIGNING_KEY_FILE is a PEM encoded RSA or Ed25519 private key. When it
+	// is set tokens are signed with it instead of JWT_SECRET.
+	JWT_SIGNING_KEY_FILE string `mapstructure:"JWT_SIGNING_KEY_FILE"`
+	// JWT_VERIFICATION_KEY_FILES is a comma separated list of PEM encoded public
+	// keys that are still accepted, e.g. the previous signing key after a rotation
+	JWT_VERIFICATION_KEY_FILES string `mapstructure:"JWT_VERIFICATION_KEY_FILES"`
+
+	// TOKEN_REVOCATION_STORE selects where revoked tokens are kept: "postgres" (default) or "memory"
+	TOKEN_REVOCATION_STORE string `mapstructure:"TOKEN_REVOCATION_STORE"`
+	// LOGIN_ATTEMPT_STORE selects where failed login counters are kept: "postgres" (default) or "memory"
+	LOGIN_ATTEMPT_STORE string `mapstructure:"LOGIN_ATTEMPT_STORE"`
+
+	// TRUST_PROXY_HEADERS takes the client IP from X-Forwarded-For / X-Real-IP.
+	// Only enable it behind a reverse proxy that sets these headers.
+	TRUST_PROXY_HEADERS bool `mapstructure:"TRUST_PROXY_HEADERS"`
+
+	// FRONTEND_URL is used to build the links sent in emails, e.g. https://byteurl.com
+	FRONTEND_URL string `mapstructure:"FRONTEND_URL"`
+
+	// SHORT_DOMAIN is the host that serves short links as real redirects, e.g.
+	// byt.eu. Requests for any other host go to the API as before.
+	SHORT_DOMAIN string `mapstructure:"SHORT_DOMAIN"`
+
+	// REQUIRE_EMAIL_VERIFICATION blocks link creation until the user has verified their email
+	REQUIRE_EMAIL_VERIFICATION bool `mapstructure:"REQUIRE_EMAIL_VERIFICATION"`
+
+	// PASSWORD_* configure the password policy. The minimum length defaults to 8
+	// and the minimum estimated strength to 40 bits.
+	PASSWORD_MIN_LENGTH   int     `mapstructure:"PASSWORD_MIN_LENGTH"`
+	PASSWORD_MIN_ENTROPY  float64 `mapstructure:"PASSWORD_MIN_ENTROPY"`
+	PASSWORD_ALLOW_COMMON bool    `mapstructure:"PASSWORD_ALLOW_COMMON"`
+	// BREACHED_PASSWORDS_PATH is a SHA-1 breach corpus, either a "HASH:COUNT"
+	// file or a directory of "PREFIX.txt" range files. Screening is off when empty.
+	BREACHED_PASSWORDS_PATH string `mapstructure:"BREACHED_PASSWORDS_PATH"`
+	// BREACHED_PASSWORDS_THRESHOLD is how many breaches a password may appear in
+	// before it is refused. Defaults to 1.
+	BREACHED_PASSWORDS_THRESHOLD int `mapstructure:"BREACHED_PASSWORDS_THRESHOLD"`
+
+	// SHORT_CODE_GENERATOR selects how short codes are generated: "random"
+	// (default), "counter" or "hashids". The counter based generators need
+	// SHORT_CODE_SECRET, changing it later makes new codes collide with old ones.
+	SHORT_CODE_GENERATOR string `mapstructure:"SHORT_CODE_GENERATOR"`
+	// SHORT_CODE_LENGTH defaults to 8 and SHORT_CODE_ALPHABET to base62
+	SHORT_CODE_LENGTH   int    `mapstructure:"SHORT_CODE_LENGTH"`
+	SHORT_CODE_ALPHABET string `mapstructure:"SHORT_CODE_ALPHABET"`
+	SHORT_CODE_SECRET   string `mapstructure:"SHORT_CODE_SECRET"`
+
+	// CLICK_FLUSH_SECONDS is how often buffered clicks are written to the
+	// database. Defaults to 5.
+	CLICK_FLUSH_SECONDS int `mapstructure:"CLICK_FLUSH_SECONDS"`
+
+	// BOOTSTRAP_ADMIN_EMAIL is promoted to the admin role on startup, so that
+	// a fresh installation has somebody who can hand out roles
+	BOOTSTRAP_ADMIN_EMAIL string `mapstructure:"BOOTSTRAP_ADMIN_EMAIL"`
+
+	// ACCOUNT_DELETION_GRACE_DAYS is how long a deleted account can still be
+	// restored before it is purged. Defaults to 30.
+	ACCOUNT_DELETION_GRACE_DAYS int `mapstructure:"ACCOUNT_DELETION_GRACE_DAYS"`
+
+	// OAUTH_REDIRECT_URL is the public base URL of this API that identity
+	// providers redirect back to, e.g. https://api.byteurl.com
+	OAUTH_REDIRECT_URL   string `mapstructure:"OAUTH_REDIRECT_URL"`
+	GITHUB_CLIENT_ID     string `mapstructure:"GITHUB_CLIENT_ID"`
+	GITHUB_CLIENT_SECRET string `mapstructure:"GITHUB_CLIENT_SECRET"`
+	GOOGLE_CLIENT_ID     string `mapstructure:"GOOGLE_CLIENT_ID"`
+	GOOGLE_CLIENT_SECRET string `mapstructure:"GOOGLE_CLIENT_SECRET"`
+
+	// OIDC_* configure a generic OpenID Connect provider that is available as /api/oauth/{OIDC_NAME}
+	OIDC_NAME          string `mapstructure:"OIDC_NAME"`
+	OIDC_ISSUER_URL    string `mapstructure:"OIDC_ISSUER_URL"`
+	OIDC_CLIENT_ID     string `mapstructure:"OIDC_CLIENT_ID"`
+	OIDC_CLIENT_SECRET string `mapstructure:"OIDC_CLIENT_SECRET"`
+
+	// MAIL_DRIVER selects how emails are sent: "smtp" or "file" (default)
+	MAIL_DRIVER   string `mapstructure:"MAIL_DRIVER"`
+	MAIL_FROM     string `mapstructure:"MAIL_FROM"`
+	MAIL_DIR      string `mapstructure:"MAIL_DIR"`
+	SMTP_HOST     string `mapstructure:"SMTP_HOST"`
+	SMTP_PORT     string `mapstructure:"SMTP_PORT"`
+	SMTP_USERNAME string `mapstructure:"SMTP_USERNAME"`
+	SMTP_PASSWORD string `mapstructure:"SMTP_PASSWORD"`
 }
 
 func LoadConfig() (config *AppConfig, err error) {
@@ -39,3 +123,24 @@ func LoadConfig() (config *AppConfig, err error) {
 
 	return config, nil
 }
+
+// AccountDeletionGracePeriod returns how long deleted accounts are kept
+// before they are purged
+func (a *AppConfig) AccountDeletionGracePeriod() time.Duration {
+	days := a.ACCOUNT_DELETION_GRACE_DAYS
+	if days <= 0 {
+		days = 30
+	}
+
+	return time.Hour * 24 * time.Duration(days)
+}
+
+// ClickFlushInterval returns how often buffered clicks are stored
+func (a *AppConfig) ClickFlushInterval() time.Duration {
+	seconds := a.CLICK_FLUSH_SECONDS
+	if seconds <= 0 {
+		seconds = 5
+	}
+
+	return time.Second * time.Duration(seconds)
+}
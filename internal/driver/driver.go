@@ -29,7 +29,10 @@ func ConnectGORM(dsn string) (*DB, error) {
 
 	// Retry connection to the database if it fails for maxRetries times
 	for retries := 0; retries < maxRetries; retries++ {
-		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
+			// Report unique violations as gorm.ErrDuplicatedKey
+			TranslateError: true,
+		})
 		if err != nil {
 			fmt.Printf("Failed to connect to the database (attempt %d/%d): %v\n", retries+1, maxRetries, err)
 			time.Sleep(retryInterval)
@@ -63,15 +66,89 @@ func ConnectGORM(dsn string) (*DB, error) {
 
 // runMigrations runs the database migrations for the models
 func runMigrations(db *gorm.DB) error {
+	// Accounts that existed before email verification was added are treated as
+	// verified, otherwise REQUIRE_EMAIL_VERIFICATION would lock all of them out
+	// of creating links and social logins would take their accounts over
+	backfillVerified := !db.Migrator().HasColumn(&models.User{}, "EmailVerifiedAt")
+
 	err := db.AutoMigrate(
 		&models.User{},
 		&models.Link{},
 		&models.RedirectHistory{},
+		&models.RefreshToken{},
+		&models.Session{},
+		&models.RevokedToken{},
+		&models.UserTokenRevocation{},
+		&models.UserToken{},
+		&models.RecoveryCode{},
+		&models.Identity{},
+		&models.APIToken{},
+		&models.LoginAttempt{},
+		&models.AuditEvent{},
+		&models.BulkJob{},
 	)
 	if err != nil {
 		fmt.Printf("Cannot migrate user table: %v\n", err)
 		return err
 	}
 
+	if backfillVerified {
+		err = db.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL").Error
+		if err != nil {
+			fmt.Printf("Cannot mark existing users as verified: %v\n", err)
+			return err
+		}
+	}
+
+	err = migrateLinkIdentifiers(db)
+	if err != nil {
+		fmt.Printf("Cannot migrate link identifiers: %v\n", err)
+		return err
+	}
+
+	// Counter for the counter based short code generators
+	err = db.Exec("CREATE SEQUENCE IF NOT EXISTS short_code_counter").Error
+	if err != nil {
+		fmt.Printf("Cannot create short code counter: %v\n", err)
+		return err
+	}
+
 	return nil
 }
+
+// migrateLinkIdentifiers moves links and redirect history from ids picked by
+// the application to ids generated by the database. Existing ids are kept, so
+// the history stays attached to its links, and the sequences are moved past
+// them. Links then get their public id and their number within the links of
+// their user, numbered in the order they were created. Every step can run
+// again safely. gen_random_uuid needs PostgreSQL 13 or later.
+func migrateLinkIdentifiers(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range []string{
+			"LOCK TABLE users, links, redirect_histories IN SHARE ROW EXCLUSIVE MODE",
+			"SELECT setval(pg_get_serial_sequence('links', 'id'), (SELECT COALESCE(MAX(id), 0) + 1 FROM links), false)",
+			"SELECT setval(pg_get_serial_sequence('redirect_histories', 'id'), (SELECT COALESCE(MAX(id), 0) + 1 FROM redirect_histories), false)",
+			"UPDATE links SET public_id = gen_random_uuid() WHERE public_id IS NULL",
+			`UPDATE links SET number = numbered.number
+				FROM (
+					SELECT id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_at, id)
+						+ (SELECT COALESCE(MAX(number), 0) FROM links AS existing WHERE existing.user_id = unnumbered.user_id) AS number
+					FROM links AS unnumbered
+					WHERE number = 0
+				) AS numbered
+				WHERE links.id = numbered.id`,
+			`UPDATE users SET last_link_number = numbers.last
+				FROM (SELECT user_id, MAX(number) AS last FROM links GROUP BY user_id) AS numbers
+				WHERE users.id = numbers.user_id AND users.last_link_number < numbers.last`,
+			// Created here rather than by AutoMigrate, which would run before the
+			// existing links have been numbered
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_links_user_number ON links (user_id, number)",
+		} {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
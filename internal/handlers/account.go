@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const emailChangeExpiry = time.Hour
+
+// ChangePassword replaces the password of a logged in user. Every other
+// session is revoked and the caller gets a fresh one.
+func (m *Repository) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	valid, err := m.checkPassword(user, payload.CurrentPassword)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify password"), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		utils.ErrorJSON(w, errors.New("invalid password"), http.StatusBadRequest)
+		return
+	}
+
+	if payload.NewPassword == payload.CurrentPassword {
+		utils.FieldErrorsJSON(w, []utils.FieldError{{
+			Field:   "newPassword",
+			Code:    "unchanged",
+			Message: "new password must be different from the current one",
+		}})
+		return
+	}
+
+	if !m.checkPasswordPolicy(w, "newPassword", payload.NewPassword, user.Name, user.Email) {
+		return
+	}
+
+	hashedPassword, err := models.HashPassword(payload.NewPassword)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = m.DB.UpdateUserPasswordByID(user.ID, hashedPassword)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to update password"), http.StatusInternalServerError)
+		return
+	}
+
+	m.audit(r, user.ID, models.AuditPasswordChanged, "")
+
+	err = m.revokeAllSessions(user.ID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to revoke sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your ByteURL password was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe password of your ByteURL account was just changed and every other session was logged out. If this was not you, reset your password right away.\n",
+			user.Name),
+	})
+
+	m.writeNewSession(w, r, user)
+}
+
+// ChangeEmail starts an email change. The address is only swapped once the
+// link sent to the new address has been followed.
+func (m *Repository) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+		NewEmail string `json:"newEmail"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	valid, err := m.checkPassword(user, payload.Password)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify password"), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		utils.ErrorJSON(w, errors.New("invalid password"), http.StatusBadRequest)
+		return
+	}
+
+	newEmail := strings.TrimSpace(payload.NewEmail)
+	if !utils.IsValidEmail(newEmail) {
+		utils.ErrorJSON(w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	if strings.EqualFold(newEmail, user.Email) {
+		utils.ErrorJSON(w, errors.New("new email must be different from the current one"), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := m.DB.UserExists(newEmail)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+	if exists {
+		utils.ErrorJSON(w, errors.New("email address is already in use"), http.StatusConflict)
+		return
+	}
+
+	// Only the most recently requested change should go through
+	err = m.DB.InvalidateUserTokens(user.ID, models.TokenScopeEmailChange)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create confirmation token"), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := m.createUserTokenWithData(user.ID, models.TokenScopeEmailChange, newEmail, emailChangeExpiry)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create confirmation token"), http.StatusInternalServerError)
+		return
+	}
+
+	confirmURL := fmt.Sprintf("%s/confirm-email?token=%s", m.App.FRONTEND_URL, url.QueryEscape(token))
+
+	m.sendMail(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new ByteURL email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm that you want to use this address for your ByteURL account by following the link below:\n\n%s\n\nThe link expires in %d minutes. If you did not request this change, you can ignore this email.\n",
+			user.Name, confirmURL, int(emailChangeExpiry.Minutes())),
+	})
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "ByteURL email change requested",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your ByteURL account to %s. The change only happens once the new address is confirmed. If this was not you, change your password right away.\n",
+			user.Name, newEmail),
+	})
+
+	m.audit(r, user.ID, models.AuditEmailChangeRequested, newEmail)
+
+	response := map[string]string{"message": "a confirmation link has been sent to the new address"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// ConfirmEmailChange swaps the email address once the link sent by
+// ChangeEmail has been followed
+func (m *Repository) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	if payload.Token == "" {
+		utils.ErrorJSON(w, errors.New("token cannot be empty"), http.StatusBadRequest)
+		return
+	}
+
+	token, err := m.DB.ConsumeUserToken(models.TokenScopeEmailChange, utils.HashToken(payload.Token))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify token"), http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired confirmation token"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(token.UserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusBadRequest)
+		return
+	}
+
+	// The address may have been taken while the link was on its way
+	exists, err := m.DB.UserExists(token.Data)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+	if exists {
+		utils.ErrorJSON(w, errors.New("email address is already in use"), http.StatusConflict)
+		return
+	}
+
+	err = m.DB.UpdateUserEmailByID(user.ID, token.Data)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to update email"), http.StatusInternalServerError)
+		return
+	}
+
+	m.audit(r, user.ID, models.AuditEmailChanged, fmt.Sprintf("%s -> %s", user.Email, token.Data))
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your ByteURL email address was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email address of your ByteURL account was changed to %s. If this was not you, contact support right away.\n",
+			user.Name, token.Data),
+	})
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// checkPassword compares a plain password with the stored hash. The user
+// returned by GetUserByID does not carry the hash, so it is loaded again.
+func (m *Repository) checkPassword(user *models.User, password string) (bool, error) {
+	fullUser, err := m.DB.GetUserByEmail(user.Email)
+	if err != nil {
+		return false, err
+	}
+	if fullUser == nil {
+		return false, nil
+	}
+
+	valid, err := fullUser.PasswordMathes(password)
+	if err != nil {
+		return false, err
+	}
+
+	return valid, nil
+}
+
+// audit records a change to an account. The actor is taken from the access
+// token when there is one. Failures are logged so that they never undo a
+// change that has already been made.
+func (m *Repository) audit(r *http.Request, userID int, action, details string) {
+	actorID := userID
+	if claims, ok := auth.ClaimsFromContext(r.Context()); ok {
+		if id, err := claims.UserID(); err == nil {
+			actorID = id
+		}
+	}
+
+	err := m.DB.InsertAuditEvent(&models.AuditEvent{
+		UserID:    userID,
+		ActorID:   actorID,
+		Action:    action,
+		Details:   details,
+		IPAddress: utils.ClientIP(r),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record audit event %s for user %d: %v\n", action, userID, err)
+	}
+}
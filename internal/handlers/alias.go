@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/elidotexe/backend_byteurl/internal/shortcode"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const aliasSuggestionCount = 3
+
+// normalizeAlias checks an alias chosen by the user and writes a field error
+// when it breaks the alias rules
+func (m *Repository) normalizeAlias(w http.ResponseWriter, alias string) (string, bool) {
+	normalized, err := shortcode.NormalizeAlias(alias)
+	if err != nil {
+		utils.FieldErrorsJSON(w, []utils.FieldError{aliasFieldError(err)})
+		return "", false
+	}
+
+	return normalized, true
+}
+
+// aliasFieldError describes an error of shortcode.NormalizeAlias as a field error
+func aliasFieldError(err error) utils.FieldError {
+	code := "invalid"
+	switch {
+	case errors.Is(err, shortcode.ErrAliasLength):
+		code = "length"
+	case errors.Is(err, shortcode.ErrAliasReserved):
+		code = "reserved"
+	}
+
+	return utils.FieldError{Field: "alias", Code: code, Message: err.Error()}
+}
+
+// aliasTaken answers with 409 and a few similar aliases that are still free
+func (m *Repository) aliasTaken(w http.ResponseWriter, alias string) {
+	suggestions := []string{}
+
+	candidates := shortcode.AliasCandidates(alias, aliasSuggestionCount*2)
+	if len(candidates) > 0 {
+		taken, err := m.DB.TakenShortenURLs(candidates)
+		if err == nil {
+			for _, candidate := range candidates {
+				if len(suggestions) < aliasSuggestionCount && !taken[candidate] {
+					suggestions = append(suggestions, candidate)
+				}
+			}
+		}
+	}
+
+	response := utils.JSONResponse{
+		Error:   true,
+		Message: "alias is already taken",
+		Data: map[string]interface{}{
+			"fields": []utils.FieldError{{
+				Field:   "alias",
+				Code:    "taken",
+				Message: "alias is already taken",
+			}},
+			"suggestions": suggestions,
+		},
+	}
+
+	_ = utils.WriteJSON(w, http.StatusConflict, response)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"context"
+)
+
+// runInBackground runs fn outside of the request, for work that is slow or
+// whose duration would tell the client something, such as sending mail. The
+// work is waited for on shutdown.
+func (m *Repository) runInBackground(fn func()) {
+	m.background.Add(1)
+	go func() {
+		defer m.background.Done()
+		fn()
+	}()
+}
+
+// WaitForBackground waits until the work started with runInBackground, bulk
+// jobs included, has finished, or until ctx is done
+func (m *Repository) WaitForBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.background.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
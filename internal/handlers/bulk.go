@@ -0,0 +1,533 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+	"github.com/elidotexe/backend_byteurl/internal/shortcode"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	bulkMaxBytes = 20 * 1024 * 1024 // 20MB
+	bulkMaxRows  = 10000
+	// Uploads up to bulkSyncRows rows are answered right away, larger ones
+	// become a job that can be polled
+	bulkSyncRows  = 100
+	bulkBatchSize = 500
+)
+
+var errBulkTooManyRows = fmt.Errorf("an upload may have at most %d rows", bulkMaxRows)
+
+// bulkRow is one link of a bulk upload. Invalid is set when the row could
+// not be read at all.
+type bulkRow struct {
+	Title       string
+	OriginalURL string
+	Alias       string
+	Invalid     string
+}
+
+// BulkCreateLinks creates many links from a JSON array or a CSV file with the
+// columns title, url and an optional alias. Every row is validated on its own
+// and the response lists the result of each row.
+func (m *Repository) BulkCreateLinks(w http.ResponseWriter, r *http.Request) {
+	pathUserID, _ := utils.GetIDFromURL(r.URL.Path)
+	userID, err := strconv.Atoi(pathUserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	if !m.canCreateLinks(w, userID) {
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, bulkMaxBytes)
+
+	var rows []bulkRow
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		rows, err = readBulkCSV(body)
+	case "", "application/json":
+		rows, err = readBulkJSON(body)
+	default:
+		utils.ErrorJSON(w, errors.New("upload must be application/json or text/csv"), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		utils.ErrorJSON(w, fmt.Errorf("upload must not be larger than %dMB", bulkMaxBytes/1024/1024), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errBulkTooManyRows):
+		utils.ErrorJSON(w, err, http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		utils.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if len(rows) == 0 {
+		utils.ErrorJSON(w, errors.New("upload has no rows"), http.StatusBadRequest)
+		return
+	}
+
+	job := &models.BulkJob{
+		UserID:    userID,
+		Status:    models.BulkJobPending,
+		Total:     len(rows),
+		CreatedAt: time.Now(),
+	}
+
+	if len(rows) <= bulkSyncRows && r.URL.Query().Get("async") != "true" {
+		err = m.processBulkRows(job, rows, func() {})
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to insert links"), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		job.Status = models.BulkJobFinished
+		job.FinishedAt = &now
+
+		_ = utils.WriteJSON(w, http.StatusOK, job)
+		return
+	}
+
+	job.ID, err = utils.GenerateSecureToken(16)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create job"), http.StatusInternalServerError)
+		return
+	}
+
+	err = m.DB.InsertBulkJob(job)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create job"), http.StatusInternalServerError)
+		return
+	}
+
+	m.runInBackground(func() {
+		m.runBulkJob(job, rows)
+	})
+
+	w.Header().Set("Location", fmt.Sprintf("/api/admin/users/%d/links/bulk/%s", userID, job.ID))
+	_ = utils.WriteJSON(w, http.StatusAccepted, job)
+}
+
+// BulkJobStatus returns the progress of a bulk upload, and the results of
+// every row once it has finished
+func (m *Repository) BulkJobStatus(w http.ResponseWriter, r *http.Request) {
+	pathUserID, _ := utils.GetIDFromURL(r.URL.Path)
+	userID, err := strconv.Atoi(pathUserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	job, err := m.DB.GetBulkJob(userID, chi.URLParam(r, "jobID"))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve job"), http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		utils.ErrorJSON(w, errors.New("job not found"), http.StatusNotFound)
+		return
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, job)
+}
+
+// runBulkJob processes an upload in the background and saves the progress
+// after every batch
+func (m *Repository) runBulkJob(job *models.BulkJob, rows []bulkRow) {
+	save := func() {
+		job.UpdatedAt = time.Now()
+		if err := m.DB.UpdateBulkJob(job); err != nil {
+			log.Printf("Failed to save bulk job %s: %v\n", job.ID, err)
+		}
+	}
+
+	job.Status = models.BulkJobRunning
+	save()
+
+	err := m.processBulkRows(job, rows, save)
+
+	now := time.Now()
+	job.FinishedAt = &now
+	if err != nil {
+		log.Printf("Bulk job %s failed: %v\n", job.ID, err)
+
+		job.Status = models.BulkJobFailed
+		job.Error = "failed to insert links"
+	} else {
+		job.Status = models.BulkJobFinished
+	}
+
+	save()
+}
+
+// processBulkRows validates every row, inserts the valid ones in batches and
+// fills in the results of the job. progress is called after every batch.
+func (m *Repository) processBulkRows(job *models.BulkJob, rows []bulkRow, progress func()) error {
+	results := make([]models.BulkResult, len(rows))
+	aliasRows := make(map[string]int)
+
+	var valid []int
+	for i := range rows {
+		results[i].Row = i + 1
+
+		fieldErrors := validateBulkRow(&rows[i])
+		if alias := rows[i].Alias; alias != "" && len(fieldErrors) == 0 {
+			if row, ok := aliasRows[alias]; ok {
+				fieldErrors = append(fieldErrors, utils.FieldError{Field: "alias", Code: "duplicate", Message: fmt.Sprintf("alias is already used by row %d", row)})
+			} else {
+				aliasRows[alias] = i + 1
+			}
+		}
+
+		if len(fieldErrors) > 0 {
+			results[i].Errors = bulkRowErrors(fieldErrors)
+			job.Failed++
+			continue
+		}
+
+		valid = append(valid, i)
+	}
+
+	job.Processed = job.Failed
+
+	for start := 0; start < len(valid); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+
+		err := m.insertBulkBatch(job.UserID, rows, valid[start:end], results)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range valid[start:end] {
+			if len(results[i].Errors) > 0 {
+				job.Failed++
+			} else {
+				job.Succeeded++
+			}
+		}
+		job.Processed += end - start
+
+		progress()
+	}
+
+	job.Results = results
+
+	return nil
+}
+
+// insertBulkBatch inserts the rows at the given indexes in one transaction
+// and records the outcome of each in results. Rows whose generated code turns
+// out to be taken are inserted again with a new code.
+func (m *Repository) insertBulkBatch(userID int, rows []bulkRow, indexes []int, results []models.BulkResult) error {
+	var aliases []string
+	for _, i := range indexes {
+		if rows[i].Alias != "" {
+			aliases = append(aliases, rows[i].Alias)
+		}
+	}
+
+	taken := map[string]bool{}
+	if len(aliases) > 0 {
+		var err error
+		taken, err = m.DB.TakenShortenURLs(aliases)
+		if err != nil {
+			return err
+		}
+	}
+
+	var links []*models.Link
+	var linkRows []int
+	for _, i := range indexes {
+		row := rows[i]
+
+		if taken[row.Alias] {
+			results[i].Errors = []models.BulkRowError{bulkAliasTaken}
+			continue
+		}
+
+		shortenURL := row.Alias
+		if shortenURL == "" {
+			var err error
+			shortenURL, err = m.Codes.Generate()
+			if err != nil {
+				return err
+			}
+		}
+
+		links = append(links, &models.Link{
+			Title:        row.Title,
+			OriginalURL:  row.OriginalURL,
+			ShortenURL:   shortenURL,
+			Status:       models.LinkStatusActive,
+			RedirectType: http.StatusFound,
+			CreatedAt:    time.Now(),
+			UpdatedAt:    time.Now(),
+		})
+		linkRows = append(linkRows, i)
+	}
+
+	// Links whose generated code was taken are inserted again with a new code
+	for attempt := 0; len(links) > 0 && attempt < shortCodeAttempts; attempt++ {
+		rowErrors, err := m.DB.InsertLinks(userID, links)
+		if err != nil {
+			return err
+		}
+
+		var retryLinks []*models.Link
+		var retryRows []int
+		for j, link := range links {
+			i := linkRows[j]
+			collided := errors.Is(rowErrors[j], repository.ErrShortURLTaken)
+
+			switch {
+			case rows[i].Alias != "" && collided:
+				results[i].Errors = []models.BulkRowError{bulkAliasTaken}
+			case rows[i].Alias != "":
+				results[i].LinkID = link.PublicID
+				results[i].Number = link.Number
+				results[i].ShortenURL = link.ShortenURL
+			case collided:
+				shortcode.RecordInsert(true)
+
+				link.ShortenURL, err = m.Codes.Generate()
+				if err != nil {
+					return err
+				}
+
+				retryLinks = append(retryLinks, link)
+				retryRows = append(retryRows, i)
+			default:
+				shortcode.RecordInsert(false)
+
+				results[i].LinkID = link.PublicID
+				results[i].Number = link.Number
+				results[i].ShortenURL = link.ShortenURL
+			}
+		}
+
+		links, linkRows = retryLinks, retryRows
+	}
+
+	for _, i := range linkRows {
+		results[i].Errors = []models.BulkRowError{{Field: "url", Code: "conflict", Message: errNoFreeShortCode.Error()}}
+	}
+
+	return nil
+}
+
+var bulkAliasTaken = models.BulkRowError{Field: "alias", Code: "taken", Message: "alias is already taken"}
+
+// validateBulkRow checks a row the same way CreateLink checks a single link
+// and folds its alias
+func validateBulkRow(row *bulkRow) []utils.FieldError {
+	if row.Invalid != "" {
+		return []utils.FieldError{{Field: "row", Code: "invalid", Message: row.Invalid}}
+	}
+
+	var fieldErrors []utils.FieldError
+
+	row.Title = strings.TrimSpace(row.Title)
+	if len(row.Title) < 3 {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "title", Code: "length", Message: "title must be at least 3 characters"})
+	}
+
+	row.OriginalURL = strings.TrimSpace(row.OriginalURL)
+	if row.OriginalURL == "" {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "url", Code: "required", Message: "url cannot be empty"})
+	} else {
+		if !utils.IsValidLinkURL(row.OriginalURL) {
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: "url", Code: "invalid", Message: "url must be an http or https url"})
+		}
+	}
+
+	if row.Alias != "" {
+		alias, err := shortcode.NormalizeAlias(row.Alias)
+		if err != nil {
+			fieldErrors = append(fieldErrors, aliasFieldError(err))
+		} else {
+			row.Alias = alias
+		}
+	}
+
+	return fieldErrors
+}
+
+func bulkRowErrors(fieldErrors []utils.FieldError) []models.BulkRowError {
+	rowErrors := make([]models.BulkRowError, len(fieldErrors))
+	for i, fieldError := range fieldErrors {
+		rowErrors[i] = models.BulkRowError(fieldError)
+	}
+
+	return rowErrors
+}
+
+// readBulkJSON reads a JSON array of {title, url, alias} objects one element
+// at a time. originalUrl is accepted in place of url, like in CreateLink.
+func readBulkJSON(body io.Reader) ([]bulkRow, error) {
+	dec := json.NewDecoder(body)
+
+	token, err := dec.Token()
+	if err != nil {
+		return nil, wrapBulkReadError(err, "body must be a JSON array")
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("body must be a JSON array")
+	}
+
+	var rows []bulkRow
+	for dec.More() {
+		if len(rows) == bulkMaxRows {
+			return nil, errBulkTooManyRows
+		}
+
+		var item struct {
+			Title       string `json:"title"`
+			URL         string `json:"url"`
+			OriginalURL string `json:"originalUrl"`
+			Alias       string `json:"alias"`
+		}
+
+		err := dec.Decode(&item)
+		if err != nil {
+			// A value of the wrong type only spoils its own row
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				rows = append(rows, bulkRow{Invalid: fmt.Sprintf("%s has the wrong type", typeErr.Field)})
+				continue
+			}
+
+			return nil, wrapBulkReadError(err, fmt.Sprintf("invalid JSON in row %d", len(rows)+1))
+		}
+
+		if item.URL == "" {
+			item.URL = item.OriginalURL
+		}
+
+		rows = append(rows, bulkRow{Title: item.Title, OriginalURL: item.URL, Alias: item.Alias})
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return nil, wrapBulkReadError(err, "body must be a JSON array")
+	}
+
+	return rows, nil
+}
+
+// readBulkCSV reads the rows of a CSV upload as they arrive. A header row
+// naming the title, url and alias columns is optional, without one the
+// columns are taken in that order.
+func readBulkCSV(body io.Reader) ([]bulkRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	columns := map[string]int{"title": 0, "url": 1, "alias": 2}
+
+	var rows []bulkRow
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, wrapBulkReadError(err, fmt.Sprintf("invalid CSV: %v", err))
+		}
+
+		if first && isBulkCSVHeader(record) {
+			columns, err = bulkCSVColumns(record)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if len(rows) == bulkMaxRows {
+			return nil, errBulkTooManyRows
+		}
+
+		rows = append(rows, bulkRow{
+			Title:       csvField(record, columns["title"]),
+			OriginalURL: csvField(record, columns["url"]),
+			Alias:       csvField(record, columns["alias"]),
+		})
+	}
+
+	return rows, nil
+}
+
+func isBulkCSVHeader(record []string) bool {
+	for _, name := range record {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "title", "url", "originalurl":
+			return true
+		}
+	}
+
+	return false
+}
+
+func bulkCSVColumns(header []string) (map[string]int, error) {
+	columns := map[string]int{"title": -1, "url": -1, "alias": -1}
+
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "originalurl" {
+			name = "url"
+		}
+
+		if _, ok := columns[name]; ok {
+			columns[name] = i
+		}
+	}
+
+	if columns["title"] < 0 || columns["url"] < 0 {
+		return nil, errors.New("CSV header must name a title and a url column")
+	}
+
+	return columns, nil
+}
+
+func csvField(record []string, column int) string {
+	if column < 0 || column >= len(record) {
+		return ""
+	}
+
+	return record[column]
+}
+
+// wrapBulkReadError keeps a body that is too large recognisable and replaces
+// any other read error with message
+func wrapBulkReadError(err error, message string) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+
+	return errors.New(message)
+}
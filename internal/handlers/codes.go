@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+	"github.com/elidotexe/backend_byteurl/internal/shortcode"
+)
+
+// shortCodeAttempts is how many generated codes are tried before giving up
+// on a link
+const shortCodeAttempts = 5
+
+var errNoFreeShortCode = errors.New("failed to find a free short code")
+
+// insertLinkWithCode gives the link a generated short code and inserts it,
+// trying new codes for as long as they are taken
+func (m *Repository) insertLinkWithCode(link *models.Link) (*models.Link, error) {
+	for attempt := 0; attempt < shortCodeAttempts; attempt++ {
+		code, err := m.Codes.Generate()
+		if err != nil {
+			return nil, err
+		}
+
+		link.ShortenURL = code
+
+		inserted, err := m.DB.InsertLink(link)
+		collided := errors.Is(err, repository.ErrShortURLTaken)
+		shortcode.RecordInsert(collided)
+		if !collided {
+			return inserted, err
+		}
+	}
+
+	return nil, errNoFreeShortCode
+}
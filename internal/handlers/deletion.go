@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+// errAccountDeleted is returned when somebody tries to log in to or sign up
+// with the email of an account that is waiting to be purged
+var errAccountDeleted = errors.New("account is scheduled for deletion")
+
+// DeleteAccount soft deletes an account. Everything that belongs to it is
+// purged by a background job once the grace period is over, until then the
+// account can be restored with the link that is emailed to the user.
+func (m *Repository) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	valid, err := m.checkPassword(user, payload.Password)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify password"), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		utils.ErrorJSON(w, errors.New("invalid password"), http.StatusBadRequest)
+		return
+	}
+
+	gracePeriod := m.App.AccountDeletionGracePeriod()
+
+	err = m.DB.InvalidateUserTokens(user.ID, models.TokenScopeAccountRestore)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create restore token"), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := m.createUserToken(user.ID, models.TokenScopeAccountRestore, gracePeriod)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create restore token"), http.StatusInternalServerError)
+		return
+	}
+
+	err = m.DB.SoftDeleteUser(user.ID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to delete account"), http.StatusInternalServerError)
+		return
+	}
+
+	m.audit(r, user.ID, models.AuditAccountDeleted, "")
+
+	err = m.revokeAllSessions(user.ID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to revoke sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	restoreURL := fmt.Sprintf("%s/restore-account?token=%s", m.App.FRONTEND_URL, url.QueryEscape(token))
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your ByteURL account has been deleted",
+		Body: fmt.Sprintf("Hi %s,\n\nYour ByteURL account has been deleted. Your links and their history will be removed for good in %d days. Until then you can restore your account with the link below:\n\n%s\n",
+			user.Name, int(gracePeriod.Hours()/24), restoreURL),
+	})
+
+	http.SetCookie(w, m.Auth.GetExpiredRefreshCookie())
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// RestoreAccount brings back an account that was deleted with DeleteAccount,
+// as long as it has not been purged yet
+func (m *Repository) RestoreAccount(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	if payload.Token == "" {
+		utils.ErrorJSON(w, errors.New("token cannot be empty"), http.StatusBadRequest)
+		return
+	}
+
+	token, err := m.DB.ConsumeUserToken(models.TokenScopeAccountRestore, utils.HashToken(payload.Token))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify token"), http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired restore token"), http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.RestoreUser(token.UserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to restore account"), http.StatusBadRequest)
+		return
+	}
+
+	m.audit(r, token.UserID, models.AuditAccountRestored, "")
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+var linkFinishedErrors = map[string]error{
+	models.LinkStatusExpired:   errors.New("link has expired"),
+	models.LinkStatusExhausted: errors.New("link has reached its click limit"),
+}
+
+// finishedLinkJSON sends visitors of a finished link to its fallback url if it
+// has one
+func finishedLinkJSON(w http.ResponseWriter, link *models.Link, status string) {
+	if link.FallbackURL != "" {
+		response := map[string]string{"originalUrl": link.FallbackURL, "status": status}
+
+		utils.WriteJSON(w, http.StatusOK, response)
+		return
+	}
+
+	utils.ErrorJSON(w, linkFinishedErrors[status], http.StatusGone)
+}
+
+// validateLinkLimits checks the optional expiry, click limit and fallback url
+// of a link
+func validateLinkLimits(expiresAt *time.Time, maxClicks *int, fallbackURL string) []utils.FieldError {
+	var fieldErrors []utils.FieldError
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "expiresAt", Code: "past", Message: "expiresAt must be in the future"})
+	}
+
+	if maxClicks != nil && *maxClicks < 1 {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "maxClicks", Code: "invalid", Message: "maxClicks must be at least 1"})
+	}
+
+	if fallbackURL != "" && !utils.IsValidLinkURL(fallbackURL) {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "fallbackUrl", Code: "invalid", Message: "fallbackUrl must be an http or https url"})
+	}
+
+	return fieldErrors
+}
+
+// redirectTypes are the status codes a link can redirect with
+var redirectTypes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// validateRedirectType checks the optional redirect status code of a link
+func validateRedirectType(redirectType int) []utils.FieldError {
+	if redirectType != 0 && !redirectTypes[redirectType] {
+		return []utils.FieldError{{Field: "redirectType", Code: "invalid", Message: "redirectType must be 301, 302, 307 or 308"}}
+	}
+
+	return nil
+}
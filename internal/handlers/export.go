@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const exportHistoryBatchSize = 500
+
+// exportProfile is the part of a user that is included in a data export
+type exportProfile struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	TOTPEnabledAt   *time.Time `json:"totpEnabledAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+}
+
+// ExportUserData streams everything stored about a user: the profile, every
+// link and the whole redirect history. ?format=zip returns a ZIP archive with
+// one JSON file per part, anything else a single JSON document.
+func (m *Repository) ExportUserData(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := m.DB.GetAllLinks(user.ID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve links"), http.StatusInternalServerError)
+		return
+	}
+
+	profile := exportProfile{
+		ID:              user.ID,
+		Name:            user.Name,
+		Email:           user.Email,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		TOTPEnabledAt:   user.TOTPEnabledAt,
+		CreatedAt:       user.CreatedAt,
+	}
+
+	m.audit(r, user.ID, models.AuditAccountExported, "")
+
+	filename := fmt.Sprintf("byteurl-export-%d-%s", user.ID, time.Now().UTC().Format("20060102"))
+
+	// Headers are gone once streaming has started, so later failures can only
+	// be logged. The client is left with a truncated, invalid file.
+	if r.URL.Query().Get("format") == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, filename))
+
+		err = m.writeExportZIP(w, user.ID, profile, links)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+
+		err = m.writeExportJSON(w, user.ID, profile, links)
+	}
+
+	if err != nil {
+		log.Printf("Failed to export data of user %d: %v\n", user.ID, err)
+	}
+}
+
+func (m *Repository) writeExportJSON(w io.Writer, userID int, profile exportProfile, links []models.Link) error {
+	enc := json.NewEncoder(w)
+
+	if _, err := io.WriteString(w, `{"profile":`); err != nil {
+		return err
+	}
+	if err := enc.Encode(profile); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, `,"links":`); err != nil {
+		return err
+	}
+	if err := enc.Encode(links); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, `,"redirectHistory":`); err != nil {
+		return err
+	}
+	if err := m.writeRedirectHistoryArray(w, userID); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "}\n")
+
+	return err
+}
+
+func (m *Repository) writeExportZIP(w io.Writer, userID int, profile exportProfile, links []models.Link) error {
+	archive := zip.NewWriter(w)
+
+	f, err := archive.Create("profile.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(profile); err != nil {
+		return err
+	}
+
+	f, err = archive.Create("links.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(links); err != nil {
+		return err
+	}
+
+	f, err = archive.Create("redirect_history.json")
+	if err != nil {
+		return err
+	}
+	if err := m.writeRedirectHistoryArray(f, userID); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// writeRedirectHistoryArray writes the redirect history of a user as a JSON
+// array, one batch at a time
+func (m *Repository) writeRedirectHistoryArray(w io.Writer, userID int) error {
+	enc := json.NewEncoder(w)
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	first := true
+	err := m.DB.EachRedirectHistory(userID, exportHistoryBatchSize, func(batch []models.RedirectHistory) error {
+		for i := range batch {
+			if !first {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			first = false
+
+			if err := enc.Encode(batch[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]")
+
+	return err
+}
@@ -2,35 +2,58 @@ package handlers
 
 import (
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/clicks"
 	"github.com/elidotexe/backend_byteurl/internal/config"
 	"github.com/elidotexe/backend_byteurl/internal/driver"
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
 	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/oauth"
+	"github.com/elidotexe/backend_byteurl/internal/passwords"
 	"github.com/elidotexe/backend_byteurl/internal/repository"
 	"github.com/elidotexe/backend_byteurl/internal/repository/dbrepo"
+	"github.com/elidotexe/backend_byteurl/internal/shortcode"
 	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
 var Repo *Repository
 
 type Repository struct {
-	App  *config.AppConfig
-	DB   repository.DatabaseRepo
-	Auth *auth.Auth
+	App       *config.AppConfig
+	DB        repository.DatabaseRepo
+	Auth      *auth.Auth
+	Mailer    mailer.Mailer
+	Providers map[string]oauth.Provider
+	Passwords *passwords.Policy
+	Codes     shortcode.Generator
+	Clicks    *clicks.Counter
+
+	// background tracks the work that runs after its request, such as bulk
+	// uploads and emails
+	background sync.WaitGroup
 }
 
-func NewRepo(a *config.AppConfig, db *driver.DB, authInstance *auth.Auth) *Repository {
+func NewRepo(a *config.AppConfig, db *driver.DB, authInstance *auth.Auth, m mailer.Mailer, providers map[string]oauth.Provider, policy *passwords.Policy, codes shortcode.Generator) *Repository {
+	dbRepo := dbrepo.NewPostgresRepo(db.Gorm, a)
+
 	return &Repository{
-		App:  a,
-		DB:   dbrepo.NewPostgresRepo(db.Gorm, a),
-		Auth: authInstance,
+		App:       a,
+		DB:        dbRepo,
+		Auth:      authInstance,
+		Mailer:    m,
+		Providers: providers,
+		Passwords: policy,
+		Codes:     codes,
+		Clicks:    clicks.NewCounter(dbRepo.IncrementLinkClicks),
 	}
 }
 
@@ -52,6 +75,16 @@ func (m *Repository) Home(w http.ResponseWriter, r *http.Request) {
 	_ = utils.WriteJSON(w, http.StatusOK, payload)
 }
 
+// JWKS publishes the public keys that access tokens can be verified with
+func (m *Repository) JWKS(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{"keys": m.Auth.JWKS()}
+
+	headers := http.Header{}
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	_ = utils.WriteJSON(w, http.StatusOK, response, headers)
+}
+
 func (m *Repository) Login(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email    string `json:"email"`
@@ -69,43 +102,205 @@ func (m *Repository) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userExists, err := m.DB.UserExists(payload.Email)
+	accountKey := auth.AccountLoginKey(payload.Email)
+	ipKey := auth.IPLoginKey(utils.ClientIP(r))
+
+	if !m.checkLoginAllowed(w, accountKey, ipKey) {
+		return
+	}
+
+	user, err := m.DB.GetUserByEmail(payload.Email)
 	if err != nil {
-		utils.ErrorJSON(w, err)
+		utils.ErrorJSON(w, errors.New("failed to retrieve user"), http.StatusInternalServerError)
 		return
 	}
-	if !userExists {
-		utils.ErrorJSON(w, errors.New("user does not exist"), http.StatusBadRequest)
+
+	// Unknown emails go through the same password check and error so that
+	// the response does not reveal whether an account exists
+	var valid bool
+	if user != nil {
+		valid, err = user.PasswordMathes(payload.Password)
+	} else {
+		_, err = dummyUser().PasswordMathes(payload.Password)
+	}
+	if !valid || err != nil {
+		m.loginFailed(w, user, accountKey, ipKey)
 		return
 	}
 
-	user, err := m.DB.GetUserByEmail(payload.Email)
+	err = m.Auth.ResetLoginFailures(accountKey)
 	if err != nil {
-		utils.ErrorJSON(w, errors.New("invalid email or password"), http.StatusBadRequest)
+		utils.ErrorJSON(w, errors.New("failed to reset login attempts"), http.StatusInternalServerError)
 		return
 	}
 
-	valid, err := user.PasswordMathes(payload.Password)
-	if !valid || err != nil {
-		utils.ErrorJSON(w, errors.New("invalid email or password"), http.StatusBadRequest)
+	m.completeLogin(w, r, user)
+}
+
+// completeLogin finishes a login once the first factor has been checked.
+// Users with two-factor authentication get an intermediate token that has to
+// be exchanged together with a TOTP code at /login/totp.
+func (m *Repository) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.TOTPEnabledAt != nil {
+		mfaToken, err := m.Auth.GenerateMFAToken(user.ID)
+		if err != nil {
+			utils.ErrorJSON(w, err)
+			return
+		}
+
+		response := map[string]interface{}{
+			"mfaRequired": true,
+			"mfaToken":    mfaToken,
+		}
+
+		_ = utils.WriteJSON(w, http.StatusOK, response)
+		return
+	}
+
+	m.writeNewSession(w, r, user)
+}
+
+// writeNewSession starts a new session for the user and writes the user with
+// a fresh access token
+func (m *Repository) writeNewSession(w http.ResponseWriter, r *http.Request, user *models.User) {
+	u, err := m.startSession(w, r, user)
+	if errors.Is(err, errAccountSuspended) {
+		utils.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		utils.ErrorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
+	response := struct {
+		User auth.JWTUser `json:"user"`
+	}{
+		User: *u,
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// startSession records a new session with its own refresh token family, sets
+// the refresh cookie and returns the user with a fresh access token
+func (m *Repository) startSession(w http.ResponseWriter, r *http.Request, user *models.User) (*auth.JWTUser, error) {
+	if user.SuspendedAt != nil {
+		return nil, errAccountSuspended
+	}
+
 	u := auth.JWTUser{
-		ID:    user.ID,
-		Name:  user.Name,
-		Email: user.Email,
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		Role:          user.Role,
 	}
 
-	token, err := m.Auth.GenerateTokenPair(&u)
+	familyID, err := utils.GenerateSecureToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	err = m.DB.InsertSession(&models.Session{
+		ID:         familyID,
+		UserID:     user.ID,
+		UserAgent:  r.UserAgent(),
+		IPAddress:  utils.ClientIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	})
+	if err != nil {
+		return nil, errors.New("failed to store session")
+	}
+
+	tokens, err := m.Auth.GenerateTokenPair(&u, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.DB.InsertRefreshToken(m.newRefreshToken(user.ID, familyID, tokens.RefreshToken))
+	if err != nil {
+		return nil, errors.New("failed to store refresh token")
+	}
+
+	u.Token = tokens.Token
+
+	refreshCookie := m.Auth.GetRefreshCookie(tokens.RefreshToken)
+	http.SetCookie(w, refreshCookie)
+
+	return &u, nil
+}
+
+func (m *Repository) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(m.Auth.CookieName)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("missing refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	current, err := m.DB.GetRefreshTokenByHash(utils.HashToken(cookie.Value))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve refresh token"), http.StatusInternalServerError)
+		return
+	}
+	if current == nil {
+		utils.ErrorJSON(w, errors.New("invalid refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	// A revoked token being presented again means it was stolen or replayed,
+	// so every token issued from the same login is revoked as well
+	if current.RevokedAt != nil {
+		m.revokeRefreshTokenFamily(w, current.FamilyID)
+		return
+	}
+
+	if time.Now().After(current.ExpiresAt) {
+		utils.ErrorJSON(w, errors.New("expired refresh token"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(current.UserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusUnauthorized)
+		return
+	}
+
+	if user.SuspendedAt != nil {
+		utils.ErrorJSON(w, errAccountSuspended, http.StatusForbidden)
+		return
+	}
+
+	u := auth.JWTUser{
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		Role:          user.Role,
+	}
+
+	tokens, err := m.Auth.GenerateTokenPair(&u, current.FamilyID)
 	if err != nil {
 		utils.ErrorJSON(w, err)
 		return
 	}
 
-	u.Token = token
+	rotated, err := m.DB.RotateRefreshToken(current, m.newRefreshToken(user.ID, current.FamilyID, tokens.RefreshToken))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to rotate refresh token"), http.StatusInternalServerError)
+		return
+	}
+	if !rotated {
+		m.revokeRefreshTokenFamily(w, current.FamilyID)
+		return
+	}
+
+	u.Token = tokens.Token
 
-	refreshCookie := m.Auth.GetRefreshCookie(u.Token)
+	refreshCookie := m.Auth.GetRefreshCookie(tokens.RefreshToken)
 	http.SetCookie(w, refreshCookie)
 
 	response := struct {
@@ -117,6 +312,102 @@ func (m *Repository) Login(w http.ResponseWriter, r *http.Request) {
 	_ = utils.WriteJSON(w, http.StatusOK, response)
 }
 
+func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
+	// The access token may already be expired, in which case there is nothing to revoke
+	_, claims, err := m.Auth.GetTokenFromHeaderAndVerify(w, r)
+	if err == nil && claims.ID != "" && claims.ExpiresAt != nil {
+		userID, _ := claims.UserID()
+
+		err = m.Auth.Revocations.RevokeToken(claims.ID, userID, claims.ExpiresAt.Time)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to revoke token"), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	cookie, err := r.Cookie(m.Auth.CookieName)
+	if err == nil {
+		refreshToken, err := m.DB.GetRefreshTokenByHash(utils.HashToken(cookie.Value))
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to retrieve refresh token"), http.StatusInternalServerError)
+			return
+		}
+
+		if refreshToken != nil {
+			err = m.DB.RevokeRefreshTokenFamily(refreshToken.FamilyID)
+			if err != nil {
+				utils.ErrorJSON(w, errors.New("failed to revoke refresh token"), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	http.SetCookie(w, m.Auth.GetExpiredRefreshCookie())
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func (m *Repository) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		utils.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	err = m.revokeAllSessions(userID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to revoke sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, m.Auth.GetExpiredRefreshCookie())
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// revokeAllSessions invalidates every access and refresh token issued to a user
+func (m *Repository) revokeAllSessions(userID int) error {
+	err := m.Auth.Revocations.RevokeUserTokens(userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return m.DB.RevokeUserRefreshTokens(userID)
+}
+
+// newRefreshToken builds the database record for a freshly issued refresh token
+func (m *Repository) newRefreshToken(userID int, familyID, plainToken string) *models.RefreshToken {
+	return &models.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: utils.HashToken(plainToken),
+		ExpiresAt: time.Now().Add(m.Auth.RefreshExpiry),
+		CreatedAt: time.Now(),
+	}
+}
+
+// revokeRefreshTokenFamily handles refresh token reuse by revoking the whole
+// token family and rejecting the request
+func (m *Repository) revokeRefreshTokenFamily(w http.ResponseWriter, familyID string) {
+	err := m.DB.RevokeRefreshTokenFamily(familyID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to revoke refresh tokens"), http.StatusInternalServerError)
+		return
+	}
+
+	utils.ErrorJSON(w, errors.New("refresh token reuse detected"), http.StatusUnauthorized)
+}
+
 func (m *Repository) Signup(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Name     string `json:"name"`
@@ -130,18 +421,25 @@ func (m *Repository) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var fieldErrors []utils.FieldError
+
 	if len(payload.Name) < 3 {
-		utils.ErrorJSON(w, errors.New("name must be at least 3 characters"), http.StatusBadRequest)
-		return
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "name", Code: "too_short", Message: "name must be at least 3 characters"})
 	}
 
 	if !utils.IsValidEmail(payload.Email) {
-		utils.ErrorJSON(w, errors.New("invalid email address"), http.StatusBadRequest)
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "email", Code: "invalid", Message: "invalid email address"})
+	}
+
+	passwordErrors, err := m.passwordFieldErrors("password", payload.Password, payload.Name, payload.Email)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to check password"), http.StatusInternalServerError)
 		return
 	}
+	fieldErrors = append(fieldErrors, passwordErrors...)
 
-	if len(payload.Password) < 8 {
-		utils.ErrorJSON(w, errors.New("password must be at least 8 characters"), http.StatusBadRequest)
+	if len(fieldErrors) > 0 {
+		utils.FieldErrorsJSON(w, fieldErrors)
 		return
 	}
 
@@ -155,6 +453,7 @@ func (m *Repository) Signup(w http.ResponseWriter, r *http.Request) {
 		Name:      payload.Name,
 		Email:     payload.Email,
 		Password:  hashedPassword,
+		Role:      auth.RoleUser,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -177,6 +476,13 @@ func (m *Repository) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The account exists at this point, so a failure here is only logged and
+	// the user can ask for a new verification email later
+	err = m.sendVerificationEmail(newUser)
+	if err != nil {
+		log.Printf("Failed to send verification email to %s: %v\n", newUser.Email, err)
+	}
+
 	response := map[string]string{"message": "success"}
 
 	_ = utils.WriteJSON(w, http.StatusOK, response)
@@ -289,9 +595,19 @@ func (m *Repository) CreateLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !m.canCreateLinks(w, userID) {
+		return
+	}
+
 	var payload struct {
-		Title       string `json:"title"`
-		OriginalURL string `json:"originalUrl"`
+		Title        string     `json:"title"`
+		OriginalURL  string     `json:"originalUrl"`
+		Alias        string     `json:"alias"`
+		ExpiresAt    *time.Time `json:"expiresAt"`
+		MaxClicks    *int       `json:"maxClicks"`
+		FallbackURL  string     `json:"fallbackUrl"`
+		RedirectType int        `json:"redirectType"`
+		Password     *string    `json:"password"`
 	}
 
 	err = utils.ReadJSON(w, r, &payload)
@@ -309,29 +625,66 @@ func (m *Repository) CreateLink(w http.ResponseWriter, r *http.Request) {
 		utils.ErrorJSON(w, errors.New("originalUrl cannot be empty"), http.StatusBadRequest)
 		return
 	}
-	_, err = url.Parse(payload.OriginalURL)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("invalid originalUrl"), http.StatusBadRequest)
+	if !utils.IsValidLinkURL(payload.OriginalURL) {
+		utils.ErrorJSON(w, errors.New("originalUrl must be an http or https url"), http.StatusBadRequest)
 		return
 	}
 
-	randHash, err := utils.GenerateRandomHash(10)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("failed to generate random hash"), http.StatusInternalServerError)
+	fieldErrors := validateLinkLimits(payload.ExpiresAt, payload.MaxClicks, payload.FallbackURL)
+	fieldErrors = append(fieldErrors, validateRedirectType(payload.RedirectType)...)
+	if len(fieldErrors) > 0 {
+		utils.FieldErrorsJSON(w, fieldErrors)
 		return
 	}
 
-	newLink := models.Link{
-		UserID:      userID,
-		Title:       payload.Title,
-		OriginalURL: payload.OriginalURL,
-		ShortenURL:  randHash,
-		Clicks:      0,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+	var shortenURL string
+	if payload.Alias != "" {
+		alias, ok := m.normalizeAlias(w, payload.Alias)
+		if !ok {
+			return
+		}
+
+		shortenURL = alias
 	}
 
-	insertLink, err := m.DB.InsertLink(&newLink)
+	if payload.RedirectType == 0 {
+		payload.RedirectType = http.StatusFound
+	}
+
+	newLink := models.Link{
+		UserID:       userID,
+		Title:        payload.Title,
+		OriginalURL:  payload.OriginalURL,
+		ShortenURL:   shortenURL,
+		Clicks:       0,
+		ExpiresAt:    payload.ExpiresAt,
+		MaxClicks:    payload.MaxClicks,
+		FallbackURL:  payload.FallbackURL,
+		Status:       models.LinkStatusActive,
+		RedirectType: payload.RedirectType,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	if payload.Password != nil && *payload.Password != "" {
+		passwordHash, ok := m.hashLinkPassword(w, *payload.Password)
+		if !ok {
+			return
+		}
+
+		newLink.PasswordHash = passwordHash
+	}
+
+	var insertLink *models.Link
+	if shortenURL != "" {
+		insertLink, err = m.DB.InsertLink(&newLink)
+		if errors.Is(err, repository.ErrShortURLTaken) {
+			m.aliasTaken(w, shortenURL)
+			return
+		}
+	} else {
+		insertLink, err = m.insertLinkWithCode(&newLink)
+	}
 	if err != nil {
 		utils.ErrorJSON(w, errors.New("failed to insert link"), http.StatusInternalServerError)
 		return
@@ -356,14 +709,41 @@ func (m *Repository) RedirectToOriginalURL(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	link.Clicks++
+	if link.DisabledAt != nil {
+		utils.ErrorJSON(w, errLinkDisabled, http.StatusGone)
+		return
+	}
 
-	_, err = m.DB.UpdateRedirectDetails(link)
+	// Finished links send visitors to their fallback url if they have one
+	if status := link.CurrentStatus(time.Now()); status != models.LinkStatusActive {
+		finishedLinkJSON(w, link, status)
+		return
+	}
+
+	// Protected links only reveal their destination with an unlock token
+	if link.PasswordHash != "" && !m.checkUnlockToken(r.Header.Get("X-Unlock-Token"), link) {
+		response := utils.JSONResponse{
+			Error:   true,
+			Message: "link is password protected",
+			Data:    map[string]bool{"passwordRequired": true},
+		}
+
+		utils.WriteJSON(w, http.StatusUnauthorized, response)
+		return
+	}
+
+	counted, err := m.countClick(link)
 	if err != nil {
 		utils.ErrorJSON(w, errors.New("failed to update link"), http.StatusInternalServerError)
 		return
 	}
 
+	if !counted {
+		// Another visitor got the last click in the meantime
+		finishedLinkJSON(w, link, models.LinkStatusExhausted)
+		return
+	}
+
 	response := map[string]string{"originalUrl": link.OriginalURL}
 
 	utils.WriteJSON(w, http.StatusOK, response)
@@ -385,11 +765,17 @@ func (m *Repository) CreateRedirectHistory(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if link.DisabledAt != nil {
+		utils.ErrorJSON(w, errLinkDisabled, http.StatusGone)
+		return
+	}
+
 	var payload struct {
 		Device    string `json:"device"`
 		Browser   string `json:"browser"`
 		IPAddress string `json:"ipAddress"`
 		Location  string `json:"location"`
+		Source    string `json:"source"`
 	}
 
 	err = utils.ReadJSON(w, r, &payload)
@@ -398,20 +784,16 @@ func (m *Repository) CreateRedirectHistory(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	fmt.Println(payload.Location)
-	fmt.Println(link.ID)
-
 	redirectHistory := models.RedirectHistory{
 		LinkID:    link.ID,
 		Device:    payload.Device,
 		Browser:   payload.Browser,
 		IPAddress: payload.IPAddress,
 		Location:  payload.Location,
+		Source:    payload.Source,
 		CreatedAt: time.Now(),
 	}
 
-	fmt.Println(redirectHistory)
-
 	_, err = m.DB.InsertRedirectHistory(&redirectHistory)
 	if err != nil {
 		utils.ErrorJSON(w, errors.New("failed to insert redirect history"), http.StatusInternalServerError)
@@ -424,32 +806,27 @@ func (m *Repository) CreateRedirectHistory(w http.ResponseWriter, r *http.Reques
 }
 
 func (m *Repository) UpdateLink(w http.ResponseWriter, r *http.Request) {
-	pathUserID, pathLinkID := utils.GetIDFromURL(r.URL.Path)
+	pathUserID, _ := utils.GetIDFromURL(r.URL.Path)
 	if pathUserID == "" {
 		utils.ErrorJSON(w, errors.New("pathUserID is empty"), http.StatusBadRequest)
 		return
 	}
 
-	if pathLinkID == "" {
-		utils.ErrorJSON(w, errors.New("pathLinkID is empty"), http.StatusBadRequest)
-		return
-	}
-
 	userID, err := strconv.Atoi(pathUserID)
 	if err != nil {
 		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
 		return
 	}
 
-	pathID, err := strconv.Atoi(pathLinkID)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
-		return
-	}
-
 	var payload struct {
-		Title       string `json:"title"`
-		OriginalURL string `json:"originalUrl"`
+		Title        string     `json:"title"`
+		OriginalURL  string     `json:"originalUrl"`
+		Alias        string     `json:"alias"`
+		ExpiresAt    *time.Time `json:"expiresAt"`
+		MaxClicks    *int       `json:"maxClicks"`
+		FallbackURL  string     `json:"fallbackUrl"`
+		RedirectType int        `json:"redirectType"`
+		Password     *string    `json:"password"`
 	}
 
 	err = utils.ReadJSON(w, r, &payload)
@@ -467,23 +844,63 @@ func (m *Repository) UpdateLink(w http.ResponseWriter, r *http.Request) {
 		utils.ErrorJSON(w, errors.New("originalUrl cannot be empty"), http.StatusBadRequest)
 		return
 	}
-	_, err = url.Parse(payload.OriginalURL)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("invalid originalUrl"), http.StatusBadRequest)
+	if !utils.IsValidLinkURL(payload.OriginalURL) {
+		utils.ErrorJSON(w, errors.New("originalUrl must be an http or https url"), http.StatusBadRequest)
 		return
 	}
 
-	link, err := m.DB.GetLink(userID, pathID)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("failed to retrieve link"), http.StatusInternalServerError)
+	fieldErrors := validateLinkLimits(payload.ExpiresAt, payload.MaxClicks, payload.FallbackURL)
+	fieldErrors = append(fieldErrors, validateRedirectType(payload.RedirectType)...)
+	if len(fieldErrors) > 0 {
+		utils.FieldErrorsJSON(w, fieldErrors)
 		return
 	}
 
+	link, ok := m.linkFromPath(w, r, userID)
+	if !ok {
+		return
+	}
+
+	// Without an alias the short url stays as it is
+	if payload.Alias != "" {
+		alias, ok := m.normalizeAlias(w, payload.Alias)
+		if !ok {
+			return
+		}
+
+		link.ShortenURL = alias
+	}
+
 	link.Title = payload.Title
 	link.OriginalURL = payload.OriginalURL
+	link.ExpiresAt = payload.ExpiresAt
+	link.MaxClicks = payload.MaxClicks
+	link.FallbackURL = payload.FallbackURL
+	if payload.RedirectType != 0 {
+		link.RedirectType = payload.RedirectType
+	}
+	link.Status = link.CurrentStatus(time.Now())
 	link.UpdatedAt = time.Now()
 
+	// Without a password the protection stays as it is, an empty one removes it
+	if payload.Password != nil {
+		if *payload.Password == "" {
+			link.PasswordHash = ""
+		} else {
+			passwordHash, ok := m.hashLinkPassword(w, *payload.Password)
+			if !ok {
+				return
+			}
+
+			link.PasswordHash = passwordHash
+		}
+	}
+
 	updatedLink, err := m.DB.UpdateLink(link)
+	if errors.Is(err, repository.ErrShortURLTaken) {
+		m.aliasTaken(w, link.ShortenURL)
+		return
+	}
 	if err != nil {
 		utils.ErrorJSON(w, errors.New("failed to update link"), http.StatusInternalServerError)
 		return
@@ -493,8 +910,8 @@ func (m *Repository) UpdateLink(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Repository) SingleLink(w http.ResponseWriter, r *http.Request) {
-	pathUserID, pathLinkID := utils.GetIDFromURL(r.URL.Path)
-	if pathUserID == "" || pathLinkID == "" {
+	pathUserID, _ := utils.GetIDFromURL(r.URL.Path)
+	if pathUserID == "" {
 		utils.ErrorJSON(w, errors.New("pathUserID is empty"), http.StatusBadRequest)
 		return
 	}
@@ -505,15 +922,8 @@ func (m *Repository) SingleLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	linkID, err := strconv.Atoi(pathLinkID)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
-		return
-	}
-
-	link, err := m.DB.GetLink(userID, linkID)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("failed to retrieve link"), http.StatusInternalServerError)
+	link, ok := m.linkFromPath(w, r, userID)
+	if !ok {
 		return
 	}
 
@@ -521,8 +931,8 @@ func (m *Repository) SingleLink(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Repository) DeleteLink(w http.ResponseWriter, r *http.Request) {
-	pathUserID, pathLinkID := utils.GetIDFromURL(r.URL.Path)
-	if pathUserID == "" || pathLinkID == "" {
+	pathUserID, _ := utils.GetIDFromURL(r.URL.Path)
+	if pathUserID == "" {
 		utils.ErrorJSON(w, errors.New("pathUserID is empty"), http.StatusBadRequest)
 		return
 	}
@@ -533,13 +943,12 @@ func (m *Repository) DeleteLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	linkID, err := strconv.Atoi(pathLinkID)
-	if err != nil {
-		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+	link, ok := m.linkFromPath(w, r, userID)
+	if !ok {
 		return
 	}
 
-	err = m.DB.DeleteLink(userID, linkID)
+	err = m.DB.DeleteLink(userID, link.ID)
 	if err != nil {
 		utils.ErrorJSON(w, errors.New("failed to delete link"), http.StatusInternalServerError)
 		return
@@ -548,6 +957,37 @@ func (m *Repository) DeleteLink(w http.ResponseWriter, r *http.Request) {
 	utils.WriteJSON(w, http.StatusOK, "Link successfully deleted!")
 }
 
+// linkFromPath loads the link named by {linkID} on a user's own routes. Links
+// are named by their public id, or by their number among the user's links.
+func (m *Repository) linkFromPath(w http.ResponseWriter, r *http.Request, userID int) (*models.Link, bool) {
+	ref := chi.URLParam(r, "linkID")
+
+	var link *models.Link
+	var err error
+	if number, convErr := strconv.Atoi(ref); convErr == nil {
+		link, err = m.DB.GetLinkByNumber(userID, number)
+	} else if _, parseErr := uuid.Parse(ref); parseErr == nil {
+		link, err = m.DB.GetLinkByPublicID(ref)
+		if link != nil && link.UserID != userID {
+			link = nil
+		}
+	} else {
+		utils.ErrorJSON(w, errors.New("invalid link id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve link"), http.StatusInternalServerError)
+		return nil, false
+	}
+	if link == nil {
+		utils.ErrorJSON(w, errors.New("link not found"), http.StatusNotFound)
+		return nil, false
+	}
+
+	return link, true
+}
+
 func (m *Repository) LinksWithRedirectHistory(w http.ResponseWriter, r *http.Request) {
 	pathUserID, _ := utils.GetIDFromURL(r.URL.Path)
 	if pathUserID == "" {
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const accountUnlockExpiry = time.Hour * 24
+
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+// dummyUser returns a user with a real bcrypt hash, so that logins for unknown
+// emails take as long as logins with a wrong password
+func dummyUser() *models.User {
+	dummyPasswordHashOnce.Do(func() {
+		hash, err := models.HashPassword("byteurl-dummy-password")
+		if err != nil {
+			log.Println("Cannot create dummy password hash:", err)
+		}
+		dummyPasswordHash = hash
+	})
+
+	return &models.User{Password: dummyPasswordHash}
+}
+
+// checkLoginAllowed writes a 429 response and returns false when the account
+// or client has to wait before trying again
+func (m *Repository) checkLoginAllowed(w http.ResponseWriter, accountKey, ipKey string) bool {
+	retryAfter, err := m.Auth.LoginRetryAfter(accountKey, ipKey)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to check login attempts"), http.StatusInternalServerError)
+		return false
+	}
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+		utils.ErrorJSON(w, errors.New("too many failed login attempts, please try again later"), http.StatusTooManyRequests)
+		return false
+	}
+
+	return true
+}
+
+// loginFailed records a failed login, emails an unlock link when the account
+// just got locked and writes the uniform login error
+func (m *Repository) loginFailed(w http.ResponseWriter, user *models.User, accountKey, ipKey string) {
+	locked, err := m.Auth.LoginFailed(accountKey, ipKey)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to record login attempt"), http.StatusInternalServerError)
+		return
+	}
+
+	if locked && user != nil {
+		err = m.sendUnlockEmail(user)
+		if err != nil {
+			log.Printf("Failed to send unlock email to %s: %v\n", user.Email, err)
+		}
+	}
+
+	utils.ErrorJSON(w, errors.New("invalid email or password"), http.StatusBadRequest)
+}
+
+func (m *Repository) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	plainToken := r.URL.Query().Get("token")
+	if plainToken == "" {
+		utils.ErrorJSON(w, errors.New("token cannot be empty"), http.StatusBadRequest)
+		return
+	}
+
+	token, err := m.DB.ConsumeUserToken(models.TokenScopeAccountUnlock, utils.HashToken(plainToken))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify token"), http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired unlock token"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(token.UserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusBadRequest)
+		return
+	}
+
+	err = m.Auth.ResetLoginFailures(auth.AccountLoginKey(user.Email))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to unlock account"), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func (m *Repository) sendUnlockEmail(user *models.User) error {
+	err := m.DB.InvalidateUserTokens(user.ID, models.TokenScopeAccountUnlock)
+	if err != nil {
+		return err
+	}
+
+	token, err := m.createUserToken(user.ID, models.TokenScopeAccountUnlock, accountUnlockExpiry)
+	if err != nil {
+		return err
+	}
+
+	unlockURL := fmt.Sprintf("%s/unlock?token=%s", m.App.FRONTEND_URL, url.QueryEscape(token))
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your ByteURL account has been locked",
+		Body: fmt.Sprintf("Hi %s,\n\nWe locked your account after too many failed login attempts. It unlocks automatically after a while, or you can unlock it right away with the link below:\n\n%s\n\nIf these attempts were not you, consider changing your password.\n",
+			user.Name, unlockURL),
+	})
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const (
+	magicLinkCookieName = "__Host-magic_nonce"
+	magicLinkTokenType  = "magic_link"
+	magicLinkExpiry     = time.Minute * 15
+)
+
+// MagicLinkLogin emails a single-use login link. The link only works in the
+// browser that asked for it, which gets a nonce cookie that has to come back
+// with the link.
+func (m *Repository) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	if !utils.IsValidEmail(payload.Email) {
+		utils.ErrorJSON(w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	nonce, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The cookie is set whether or not the account exists, so that the
+	// response does not reveal which emails are registered
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookieName,
+		Path:     "/",
+		Value:    nonce,
+		MaxAge:   int(magicLinkExpiry.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	response := map[string]string{"message": "if an account exists for this email, a login link has been sent"}
+
+	user, err := m.DB.GetUserByEmail(payload.Email)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+	if user == nil {
+		_ = utils.WriteJSON(w, http.StatusOK, response)
+		return
+	}
+
+	// Only the most recently requested link should work
+	err = m.DB.InvalidateUserTokens(user.ID, models.TokenScopeMagicLogin)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create login link"), http.StatusInternalServerError)
+		return
+	}
+
+	// The link is a signed token bound to the nonce. The random id inside it is
+	// stored like any other emailed token so that the link works only once.
+	linkID, err := m.createUserToken(user.ID, models.TokenScopeMagicLogin, magicLinkExpiry)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create login link"), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := m.Auth.GenerateSignedToken(magicLinkTokenType, fmt.Sprint(user.ID), map[string]string{
+		"lid":   linkID,
+		"nonce": utils.HashToken(nonce),
+	}, magicLinkExpiry)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to create login link"), http.StatusInternalServerError)
+		return
+	}
+
+	loginURL := fmt.Sprintf("%s/login/magic?token=%s", m.App.FRONTEND_URL, url.QueryEscape(token))
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your ByteURL login link",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to log in to ByteURL. It only works once, in the browser you requested it from, and expires in %d minutes:\n\n%s\n\nIf you did not request this link, you can ignore this email.\n",
+			user.Name, int(magicLinkExpiry.Minutes()), loginURL),
+	})
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// MagicLinkCallback exchanges a login link for the same response as Login
+func (m *Repository) MagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	claims, err := m.Auth.VerifySignedToken(payload.Token, magicLinkTokenType)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired login link"), http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(magicLinkCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(utils.HashToken(cookie.Value)), []byte(claims.Data["nonce"])) != 1 {
+		utils.ErrorJSON(w, errors.New("login link must be opened in the browser it was requested from"), http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired login link"), http.StatusUnauthorized)
+		return
+	}
+
+	token, err := m.DB.ConsumeUserToken(models.TokenScopeMagicLogin, utils.HashToken(claims.Data["lid"]))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify login link"), http.StatusInternalServerError)
+		return
+	}
+	if token == nil || token.UserID != userID {
+		utils.ErrorJSON(w, errors.New("invalid or expired login link"), http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookieName,
+		Path:     "/",
+		Value:    "",
+		MaxAge:   -1,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusUnauthorized)
+		return
+	}
+
+	// Following the link proves that the user owns the address
+	if user.EmailVerifiedAt == nil {
+		err = m.DB.MarkUserEmailVerified(user.ID)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to verify email"), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	m.completeLogin(w, r, user)
+}
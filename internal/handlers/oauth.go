@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/oauth"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oauthStateCookieName = "__Host-oauth_state"
+	oauthStateTokenType  = "oauth_state"
+	oauthStateExpiry     = time.Minute * 10
+)
+
+// OAuthLogin sends the user to the identity provider. The state, nonce and
+// PKCE verifier are kept in a signed cookie until the provider redirects back.
+func (m *Repository) OAuthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := m.Providers[chi.URLParam(r, "provider")]
+	if !ok {
+		utils.ErrorJSON(w, errors.New("unknown provider"), http.StatusNotFound)
+		return
+	}
+
+	state, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	nonce, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	stateToken, err := m.Auth.GenerateSignedToken(oauthStateTokenType, provider.Name(), map[string]string{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	}, oauthStateExpiry)
+	if err != nil {
+		utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// SameSite must be Lax so that the cookie is sent when the provider
+	// redirects back to us
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Path:     "/",
+		Value:    stateToken,
+		MaxAge:   int(oauthStateExpiry.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	http.Redirect(w, r, provider.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+// OAuthCallback finishes the login with the identity provider, links the
+// external identity to a user and redirects back to the frontend. The
+// frontend then gets an access token from /api/refresh.
+func (m *Repository) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := m.Providers[chi.URLParam(r, "provider")]
+	if !ok {
+		utils.ErrorJSON(w, errors.New("unknown provider"), http.StatusNotFound)
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookieName)
+	if err != nil {
+		m.oauthFailed(w, r, "login session expired")
+		return
+	}
+
+	// The state cookie is single use
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		SameSite: http.SameSiteLaxMode,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	claims, err := m.Auth.VerifySignedToken(cookie.Value, oauthStateTokenType)
+	if err != nil || claims.Subject != provider.Name() {
+		m.oauthFailed(w, r, "login session expired")
+		return
+	}
+
+	query := r.URL.Query()
+
+	if query.Get("error") != "" {
+		m.oauthFailed(w, r, "login was cancelled")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(claims.Data["state"])) != 1 {
+		m.oauthFailed(w, r, "invalid login state")
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), query.Get("code"), claims.Data["verifier"], claims.Data["nonce"])
+	if err != nil {
+		log.Printf("OAuth exchange with %s failed: %v\n", provider.Name(), err)
+		m.oauthFailed(w, r, "login failed")
+		return
+	}
+
+	user, err := m.userForIdentity(identity)
+	if err != nil {
+		if errors.Is(err, oauth.ErrEmailNotVerified) || errors.Is(err, errAccountDeleted) {
+			m.oauthFailed(w, r, err.Error())
+			return
+		}
+
+		log.Printf("Cannot link %s identity: %v\n", provider.Name(), err)
+		m.oauthFailed(w, r, "login failed")
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		mfaToken, err := m.Auth.GenerateMFAToken(user.ID)
+		if err != nil {
+			m.oauthFailed(w, r, "login failed")
+			return
+		}
+
+		http.Redirect(w, r, m.App.FRONTEND_URL+"/login/totp#mfaToken="+url.QueryEscape(mfaToken), http.StatusFound)
+		return
+	}
+
+	_, err = m.startSession(w, r, user)
+	if errors.Is(err, errAccountSuspended) {
+		m.oauthFailed(w, r, err.Error())
+		return
+	}
+	if err != nil {
+		m.oauthFailed(w, r, "login failed")
+		return
+	}
+
+	http.Redirect(w, r, m.App.FRONTEND_URL+"/oauth/callback", http.StatusFound)
+}
+
+// userForIdentity returns the user linked to an external identity. Unknown
+// identities are linked to the user with the same verified email, or to a
+// newly created user.
+func (m *Repository) userForIdentity(identity *oauth.Identity) (*models.User, error) {
+	linked, err := m.DB.GetIdentity(identity.Provider, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if linked != nil {
+		return m.DB.GetUserByID(linked.UserID)
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, oauth.ErrEmailNotVerified
+	}
+
+	user, err := m.DB.GetUserByEmail(identity.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		exists, err := m.DB.UserExists(identity.Email)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, errAccountDeleted
+		}
+
+		hashedPassword, err := unusablePasswordHash()
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+
+		name := identity.Name
+		if name == "" {
+			name = identity.Email
+		}
+
+		user = &models.User{
+			Name:            name,
+			Email:           identity.Email,
+			EmailVerifiedAt: &now,
+			Password:        hashedPassword,
+			Role:            auth.RoleUser,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+
+		err = m.DB.CreateUser(user)
+		if err != nil {
+			return nil, err
+		}
+	} else if user.EmailVerifiedAt == nil {
+		// Somebody registered this email without proving they own it. The
+		// provider has now proven who does, so lock out the existing password
+		// and sessions before linking the accounts. Accounts from before email
+		// verification existed were marked as verified and never end up here.
+		hashedPassword, err := unusablePasswordHash()
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.DB.UpdateUserPasswordByID(user.ID, hashedPassword)
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.revokeAllSessions(user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.DB.MarkUserEmailVerified(user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	err = m.DB.InsertIdentity(&models.Identity{
+		UserID:    user.ID,
+		Provider:  identity.Provider,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// unusablePasswordHash hashes a random password that nobody knows. Social
+// login users can set a real one through the password reset flow.
+func unusablePasswordHash() (string, error) {
+	unusablePassword, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	return models.HashPassword(unusablePassword)
+}
+
+// oauthFailed sends the browser back to the frontend login page with an error
+func (m *Repository) oauthFailed(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, m.App.FRONTEND_URL+"/login?error="+url.QueryEscape(message), http.StatusFound)
+}
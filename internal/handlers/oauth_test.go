@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/oauth"
+	"github.com/elidotexe/backend_byteurl/internal/oauth/oauthtest"
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+	"github.com/elidotexe/backend_byteurl/internal/repository/dbrepo"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// identityDB keeps the users and identities that userForIdentity works with
+// in memory. Any other method panics through the nil DatabaseRepo.
+type identityDB struct {
+	repository.DatabaseRepo
+
+	users              map[int]*models.User
+	identities         []models.Identity
+	revokedRefreshUser []int
+}
+
+func newIdentityDB(users ...*models.User) *identityDB {
+	db := &identityDB{users: make(map[int]*models.User)}
+	for _, user := range users {
+		db.users[user.ID] = user
+	}
+
+	return db
+}
+
+func (db *identityDB) GetUserByEmail(email string) (*models.User, error) {
+	for _, user := range db.users {
+		if user.Email == email && !user.DeletedAt.Valid {
+			return user, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (db *identityDB) GetUserByID(id int) (*models.User, error) {
+	user, ok := db.users[id]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+
+	return user, nil
+}
+
+func (db *identityDB) UserExists(email string) (bool, error) {
+	for _, user := range db.users {
+		if user.Email == email {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (db *identityDB) CreateUser(user *models.User) error {
+	user.ID = len(db.users) + 1
+	db.users[user.ID] = user
+
+	return nil
+}
+
+func (db *identityDB) UpdateUserPasswordByID(userID int, hashedPassword string) error {
+	db.users[userID].Password = hashedPassword
+
+	return nil
+}
+
+func (db *identityDB) MarkUserEmailVerified(userID int) error {
+	now := time.Now()
+	db.users[userID].EmailVerifiedAt = &now
+
+	return nil
+}
+
+func (db *identityDB) RevokeUserRefreshTokens(userID int) error {
+	db.revokedRefreshUser = append(db.revokedRefreshUser, userID)
+
+	return nil
+}
+
+func (db *identityDB) GetIdentity(provider, subject string) (*models.Identity, error) {
+	for _, identity := range db.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (db *identityDB) InsertIdentity(identity *models.Identity) error {
+	db.identities = append(db.identities, *identity)
+
+	return nil
+}
+
+func newIdentityRepo(db *identityDB) *Repository {
+	return &Repository{
+		DB:   db,
+		Auth: &auth.Auth{Revocations: dbrepo.NewMemoryRevocationRepo()},
+	}
+}
+
+// identityFromIdP logs in at a local identity provider and returns the
+// identity the provider vouches for
+func identityFromIdP(t *testing.T, login oauthtest.Login) *oauth.Identity {
+	t.Helper()
+
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(login)
+
+	provider, err := oauth.NewOIDCProvider(context.Background(), "test", oauth.ProviderConfig{
+		ClientID:    "byteurl",
+		RedirectURL: "https://api.byteurl.test/api/oauth/test/callback",
+		IssuerURL:   idp.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	callback, err := idp.Authorize(provider.AuthCodeURL("state", "nonce", verifier))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	identity, err := provider.Exchange(context.Background(), callback.Query().Get("code"), verifier, "nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	return identity
+}
+
+func verifiedUser(id int, email string) *models.User {
+	verifiedAt := time.Now().Add(-time.Hour)
+
+	return &models.User{ID: id, Email: email, EmailVerifiedAt: &verifiedAt, Password: "existing-hash", Role: auth.RoleUser}
+}
+
+func TestUserForIdentityLinkedIdentity(t *testing.T) {
+	user := verifiedUser(1, "ada@example.com")
+	db := newIdentityDB(user)
+	db.identities = append(db.identities, models.Identity{UserID: 1, Provider: "test", Subject: "user-1"})
+
+	// The email at the provider has changed since the identity was linked
+	identity := identityFromIdP(t, oauthtest.Login{Subject: "user-1", Email: "ada@elsewhere.example", EmailVerified: true})
+
+	got, err := newIdentityRepo(db).userForIdentity(identity)
+	if err != nil {
+		t.Fatalf("userForIdentity: %v", err)
+	}
+
+	if got.ID != 1 {
+		t.Errorf("user = %d, want 1", got.ID)
+	}
+
+	if len(db.users) != 1 || len(db.identities) != 1 {
+		t.Errorf("userForIdentity created %d users and %d identities, want none", len(db.users)-1, len(db.identities)-1)
+	}
+}
+
+func TestUserForIdentityRejectsUnverifiedEmail(t *testing.T) {
+	db := newIdentityDB(verifiedUser(1, "ada@example.com"))
+
+	identity := identityFromIdP(t, oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: false})
+
+	_, err := newIdentityRepo(db).userForIdentity(identity)
+	if !errors.Is(err, oauth.ErrEmailNotVerified) {
+		t.Fatalf("err = %v, want %v", err, oauth.ErrEmailNotVerified)
+	}
+
+	if len(db.identities) != 0 {
+		t.Error("an identity with an unverified email was linked")
+	}
+
+	if db.users[1].Password != "existing-hash" {
+		t.Error("the password of the existing user was changed")
+	}
+}
+
+func TestUserForIdentityCreatesUser(t *testing.T) {
+	db := newIdentityDB()
+
+	identity := identityFromIdP(t, oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada"})
+
+	user, err := newIdentityRepo(db).userForIdentity(identity)
+	if err != nil {
+		t.Fatalf("userForIdentity: %v", err)
+	}
+
+	if user.Email != "ada@example.com" || user.Name != "Ada" || user.Role != auth.RoleUser {
+		t.Errorf("user = %+v", user)
+	}
+
+	if user.EmailVerifiedAt == nil {
+		t.Error("the new user's email is not marked as verified")
+	}
+
+	if user.Password == "" {
+		t.Error("the new user has no password hash")
+	}
+
+	if len(db.identities) != 1 || db.identities[0].UserID != user.ID {
+		t.Errorf("identities = %+v, want one for user %d", db.identities, user.ID)
+	}
+}
+
+func TestUserForIdentityLinksVerifiedUser(t *testing.T) {
+	db := newIdentityDB(verifiedUser(1, "ada@example.com"))
+
+	identity := identityFromIdP(t, oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true})
+
+	user, err := newIdentityRepo(db).userForIdentity(identity)
+	if err != nil {
+		t.Fatalf("userForIdentity: %v", err)
+	}
+
+	if user.ID != 1 {
+		t.Errorf("user = %d, want 1", user.ID)
+	}
+
+	// The owner of a verified account keeps their password and sessions
+	if user.Password != "existing-hash" {
+		t.Error("the password of a verified user was replaced")
+	}
+
+	if len(db.revokedRefreshUser) != 0 {
+		t.Error("the sessions of a verified user were revoked")
+	}
+
+	if len(db.identities) != 1 || db.identities[0].UserID != 1 {
+		t.Errorf("identities = %+v, want one for user 1", db.identities)
+	}
+}
+
+func TestUserForIdentityTakesOverUnverifiedUser(t *testing.T) {
+	// Somebody registered the email without proving they own it
+	squatter := &models.User{ID: 1, Email: "ada@example.com", Password: "squatter-hash", Role: auth.RoleUser}
+	db := newIdentityDB(squatter)
+	repo := newIdentityRepo(db)
+
+	issuedBefore := time.Now().Add(-time.Second)
+
+	identity := identityFromIdP(t, oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true})
+
+	user, err := repo.userForIdentity(identity)
+	if err != nil {
+		t.Fatalf("userForIdentity: %v", err)
+	}
+
+	if user.Password == "squatter-hash" {
+		t.Error("the password set by the unverified registration still works")
+	}
+
+	if user.EmailVerifiedAt == nil {
+		t.Error("the email is not marked as verified")
+	}
+
+	if len(db.revokedRefreshUser) != 1 || db.revokedRefreshUser[0] != 1 {
+		t.Error("the refresh tokens of the unverified registration were not revoked")
+	}
+
+	revoked, err := repo.Auth.Revocations.IsTokenRevoked("", 1, issuedBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Error("the access tokens of the unverified registration were not revoked")
+	}
+
+	if len(db.identities) != 1 || db.identities[0].UserID != 1 {
+		t.Errorf("identities = %+v, want one for user 1", db.identities)
+	}
+}
+
+func TestUserForIdentityRejectsDeletedAccount(t *testing.T) {
+	deleted := verifiedUser(1, "ada@example.com")
+	deleted.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	db := newIdentityDB(deleted)
+
+	identity := identityFromIdP(t, oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true})
+
+	_, err := newIdentityRepo(db).userForIdentity(identity)
+	if !errors.Is(err, errAccountDeleted) {
+		t.Fatalf("err = %v, want %v", err, errAccountDeleted)
+	}
+
+	if len(db.users) != 1 || len(db.identities) != 0 {
+		t.Error("a deleted account was replaced or linked")
+	}
+}
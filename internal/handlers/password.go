@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const passwordResetExpiry = time.Hour
+
+func (m *Repository) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	if !utils.IsValidEmail(payload.Email) {
+		utils.ErrorJSON(w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	// The reset is looked up and sent in the background so that neither the
+	// answer nor the time it takes tell whether the email is registered
+	m.runInBackground(func() {
+		err := m.sendPasswordReset(payload.Email)
+		if err != nil {
+			log.Printf("Failed to send password reset: %v\n", err)
+		}
+	})
+
+	response := map[string]string{"message": "if an account exists for this email, a reset link has been sent"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// sendPasswordReset emails a reset link to the user with the given email, if
+// there is one. Only the most recently requested link works.
+func (m *Repository) sendPasswordReset(email string) error {
+	user, err := m.DB.GetUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+
+	err = m.DB.InvalidateUserTokens(user.ID, models.TokenScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	token, err := m.createUserToken(user.ID, models.TokenScopePasswordReset, passwordResetExpiry)
+	if err != nil {
+		return err
+	}
+
+	resetURL := fmt.Sprintf("%s/reset-password?token=%s", m.App.FRONTEND_URL, url.QueryEscape(token))
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your ByteURL password",
+		Body: fmt.Sprintf("Hi %s,\n\nWe received a request to reset your password. Use the link below to choose a new one:\n\n%s\n\nThe link expires in %d minutes. If you did not request a reset, you can ignore this email.\n",
+			user.Name, resetURL, int(passwordResetExpiry.Minutes())),
+	})
+
+	return nil
+}
+
+func (m *Repository) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	if payload.Token == "" {
+		utils.ErrorJSON(w, errors.New("token cannot be empty"), http.StatusBadRequest)
+		return
+	}
+
+	// The token is only looked at here, so that it can be used again with a
+	// better password if this one is refused
+	token, err := m.DB.GetUserToken(models.TokenScopePasswordReset, utils.HashToken(payload.Token))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify reset token"), http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired reset token"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(token.UserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired reset token"), http.StatusBadRequest)
+		return
+	}
+
+	if !m.checkPasswordPolicy(w, "password", payload.Password, user.Name, user.Email) {
+		return
+	}
+
+	hashedPassword, err := models.HashPassword(payload.Password)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	token, err = m.DB.ConsumeUserToken(models.TokenScopePasswordReset, utils.HashToken(payload.Token))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify reset token"), http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired reset token"), http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.UpdateUserPasswordByID(token.UserID, hashedPassword)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to update password"), http.StatusInternalServerError)
+		return
+	}
+
+	err = m.revokeAllSessions(token.UserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to revoke sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// createUserToken stores a new single-use token for the user and returns its
+// plain text value, which is only ever sent to the user
+func (m *Repository) createUserToken(userID int, scope string, expiry time.Duration) (string, error) {
+	return m.createUserTokenWithData(userID, scope, "", expiry)
+}
+
+// createUserTokenWithData is createUserToken for scopes that need to carry a
+// value, such as the new address of an email change
+func (m *Repository) createUserTokenWithData(userID int, scope, data string, expiry time.Duration) (string, error) {
+	token, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.DB.InsertUserToken(&models.UserToken{
+		UserID:    userID,
+		Scope:     scope,
+		TokenHash: utils.HashToken(token),
+		Data:      data,
+		ExpiresAt: time.Now().Add(expiry),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// sendMail sends an email and logs failures instead of returning them, so
+// that callers can answer uniformly whether or not delivery worked
+func (m *Repository) sendMail(msg mailer.Message) {
+	err := m.Mailer.Send(msg)
+	if err != nil {
+		log.Printf("Failed to send mail to %s: %v\n", msg.To, err)
+	}
+}
+
+// passwordFieldErrors checks a new password against the password policy and
+// returns the rules it breaks as errors for the given field
+func (m *Repository) passwordFieldErrors(field, password string, userInputs ...string) ([]utils.FieldError, error) {
+	violations, err := m.Passwords.Validate(password, userInputs...)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldErrors := make([]utils.FieldError, 0, len(violations))
+	for _, violation := range violations {
+		fieldErrors = append(fieldErrors, utils.FieldError{
+			Field:   field,
+			Code:    violation.Code,
+			Message: violation.Message,
+		})
+	}
+
+	return fieldErrors, nil
+}
+
+// checkPasswordPolicy writes the field errors of a refused password and
+// reports whether the password can be used
+func (m *Repository) checkPasswordPolicy(w http.ResponseWriter, field, password string, userInputs ...string) bool {
+	fieldErrors, err := m.passwordFieldErrors(field, password, userInputs...)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to check password"), http.StatusInternalServerError)
+		return false
+	}
+
+	if len(fieldErrors) > 0 {
+		utils.FieldErrorsJSON(w, fieldErrors)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	linkUnlockTokenType   = "link_unlock"
+	linkUnlockTokenExpiry = time.Minute * 5
+	minLinkPasswordLength = 4
+	maxLinkPasswordLength = 72
+)
+
+// UnlockLink checks the password of a protected link and returns a short-lived
+// token that has to be sent as X-Unlock-Token to GET /redirect/{short}
+func (m *Repository) UnlockLink(w http.ResponseWriter, r *http.Request) {
+	link, err := m.DB.GetLinkByShortenURL(chi.URLParam(r, "short"))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("link not found"), http.StatusNotFound)
+		return
+	}
+
+	if link.PasswordHash == "" {
+		utils.ErrorJSON(w, errors.New("link is not password protected"), http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		Password string `json:"password"`
+	}
+
+	err = utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	ip := utils.ClientIP(r)
+	linkKey := auth.LinkUnlockKey(link.ID, ip)
+	ipKey := auth.IPUnlockKey(ip)
+
+	retryAfter, err := m.Auth.LoginRetryAfter(linkKey, ipKey)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to check unlock attempts"), http.StatusInternalServerError)
+		return
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+		utils.ErrorJSON(w, errors.New("too many failed attempts, please try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	valid, err := link.PasswordMatches(payload.Password)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to check password"), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		_, err = m.Auth.LoginFailed(linkKey, ipKey)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to record unlock attempt"), http.StatusInternalServerError)
+			return
+		}
+
+		utils.ErrorJSON(w, errors.New("invalid password"), http.StatusUnauthorized)
+		return
+	}
+
+	err = m.Auth.ResetLoginFailures(linkKey)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to reset unlock attempts"), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := m.Auth.GenerateSignedToken(linkUnlockTokenType, link.PublicID, map[string]string{
+		"pwd": linkPasswordFingerprint(link),
+	}, linkUnlockTokenExpiry)
+	if err != nil {
+		utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"unlockToken": token,
+		"expiresIn":   int(linkUnlockTokenExpiry.Seconds()),
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// checkUnlockToken reports whether token unlocks the link. Tokens stop
+// working as soon as the password of the link changes.
+func (m *Repository) checkUnlockToken(token string, link *models.Link) bool {
+	if token == "" {
+		return false
+	}
+
+	claims, err := m.Auth.VerifySignedToken(token, linkUnlockTokenType)
+	if err != nil {
+		return false
+	}
+
+	if claims.Subject != link.PublicID {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(claims.Data["pwd"]), []byte(linkPasswordFingerprint(link))) == 1
+}
+
+// hashLinkPassword hashes the password of a protected link and writes a field
+// error when it cannot be used
+func (m *Repository) hashLinkPassword(w http.ResponseWriter, password string) (string, bool) {
+	if len(password) < minLinkPasswordLength || len(password) > maxLinkPasswordLength {
+		utils.FieldErrorsJSON(w, []utils.FieldError{{
+			Field:   "password",
+			Code:    "length",
+			Message: fmt.Sprintf("password must be between %d and %d characters", minLinkPasswordLength, maxLinkPasswordLength),
+		}})
+		return "", false
+	}
+
+	hash, err := models.HashPassword(password)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to hash password"), http.StatusInternalServerError)
+		return "", false
+	}
+
+	return hash, true
+}
+
+// linkPasswordFingerprint identifies the current password of a link without
+// revealing its hash
+func linkPasswordFingerprint(link *models.Link) string {
+	return utils.HashToken(link.PasswordHash)[:16]
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/elidotexe/backend_byteurl/internal/qrcode"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// qrSource is added to the url in a QR code as ?src=qr, so that scans show
+	// up as their own source in the redirect history
+	qrSource = "qr"
+
+	qrCacheControl = "public, max-age=86400"
+)
+
+var qrContentTypes = map[string]string{
+	"png": "image/png",
+	"svg": "image/svg+xml",
+}
+
+// LinkQRCode renders a QR code of a short link as PNG or SVG
+func (m *Repository) LinkQRCode(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = "png"
+	}
+
+	opts, fieldErrors := qrOptions(query)
+	if _, ok := qrContentTypes[format]; !ok {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "format", Code: "invalid", Message: "format must be png or svg"})
+	}
+	if len(fieldErrors) > 0 {
+		utils.FieldErrorsJSON(w, fieldErrors)
+		return
+	}
+
+	link, err := m.DB.GetLinkByShortenURL(chi.URLParam(r, "short"))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("link not found"), http.StatusNotFound)
+		return
+	}
+
+	if link.DisabledAt != nil {
+		utils.ErrorJSON(w, errLinkDisabled, http.StatusGone)
+		return
+	}
+
+	text := fmt.Sprintf("%s?src=%s", m.shortLinkURL(link.ShortenURL), qrSource)
+
+	// The image only depends on the encoded text and the options, so the
+	// same request always produces the same bytes
+	etag := fmt.Sprintf(`"%s"`, utils.HashToken(fmt.Sprintf("%s|%s|%+v", format, text, opts))[:32])
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", qrCacheControl)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	code, err := qrcode.Encode(text, opts)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to encode qr code"), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if format == "svg" {
+		err = code.WriteSVG(&buf)
+	} else {
+		err = code.WritePNG(&buf)
+	}
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to render qr code"), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", qrContentTypes[format])
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// qrOptions reads the size, margin, ec, fg and bg query parameters
+func qrOptions(query url.Values) (qrcode.Options, []utils.FieldError) {
+	opts := qrcode.DefaultOptions()
+
+	var fieldErrors []utils.FieldError
+	invalid := func(field string, err error) {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: field, Code: "invalid", Message: err.Error()})
+	}
+
+	if v := query.Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < qrcode.MinSize || size > qrcode.MaxSize {
+			invalid("size", qrcode.ErrSize)
+		} else {
+			opts.Size = size
+		}
+	}
+
+	if v := query.Get("margin"); v != "" {
+		margin, err := strconv.Atoi(v)
+		if err != nil || margin < 0 || margin > qrcode.MaxMargin {
+			invalid("margin", qrcode.ErrMargin)
+		} else {
+			opts.Margin = margin
+		}
+	}
+
+	if v := query.Get("ec"); v != "" {
+		level, err := qrcode.ParseLevel(v)
+		if err != nil {
+			invalid("ec", err)
+		} else {
+			opts.Level = level
+		}
+	}
+
+	if v := query.Get("fg"); v != "" {
+		fg, err := qrcode.ParseColor(v)
+		if err != nil {
+			invalid("fg", err)
+		} else {
+			opts.Foreground = fg
+		}
+	}
+
+	if v := query.Get("bg"); v != "" {
+		bg, err := qrcode.ParseColor(v)
+		if err != nil {
+			invalid("bg", err)
+		} else {
+			opts.Background = bg
+		}
+	}
+
+	if len(fieldErrors) == 0 && opts.Foreground == opts.Background {
+		fieldErrors = append(fieldErrors, utils.FieldError{Field: "fg", Code: "contrast", Message: "foreground and background colours must differ"})
+	}
+
+	return opts, fieldErrors
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+
+	return false
+}
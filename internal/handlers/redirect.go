@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// shortLinkReferrerPolicy keeps the short code out of the Referer header,
+	// destinations only learn that the visitor came through the short domain
+	shortLinkReferrerPolicy = "strict-origin"
+	// permanentRedirectMaxAge is how long browsers may keep a permanent redirect
+	permanentRedirectMaxAge = time.Hour * 24
+	maxSourceLength         = 32
+)
+
+// ShortLinkRedirect answers GET /{short} on the short domain with a redirect
+// to the destination of the link and records the click on the way
+func (m *Repository) ShortLinkRedirect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Referrer-Policy", shortLinkReferrerPolicy)
+
+	link, err := m.DB.GetLinkByShortenURL(chi.URLParam(r, "short"))
+	if err != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	status := link.CurrentStatus(now)
+
+	switch {
+	case link.DisabledAt != nil:
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, errLinkDisabled.Error(), http.StatusGone)
+		return
+	case status != models.LinkStatusActive:
+		finishedLinkRedirect(w, r, link, status)
+		return
+	case link.PasswordHash != "":
+		// The frontend asks for the password and unlocks the link
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, fmt.Sprintf("%s/%s", m.App.FRONTEND_URL, url.PathEscape(link.ShortenURL)), http.StatusFound)
+		return
+	}
+
+	if r.Method != http.MethodHead {
+		counted, err := m.countClick(link)
+		if err != nil {
+			log.Printf("Failed to count click on link %d: %v\n", link.ID, err)
+		} else if !counted {
+			// Another visitor got the last click in the meantime
+			finishedLinkRedirect(w, r, link, models.LinkStatusExhausted)
+			return
+		}
+
+		m.recordClick(r, link)
+	}
+
+	redirectType := link.RedirectType
+	if !redirectTypes[redirectType] {
+		redirectType = http.StatusFound
+	}
+
+	w.Header().Set("Cache-Control", redirectCacheControl(link, redirectType, now))
+	http.Redirect(w, r, link.OriginalURL, redirectType)
+}
+
+// finishedLinkRedirect sends visitors of a finished link to its fallback url,
+// or tells them the link is gone
+func finishedLinkRedirect(w http.ResponseWriter, r *http.Request, link *models.Link, status string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if link.FallbackURL != "" {
+		http.Redirect(w, r, link.FallbackURL, http.StatusFound)
+		return
+	}
+
+	http.Error(w, linkFinishedErrors[status].Error(), http.StatusGone)
+}
+
+// countClick counts a click on the link. Clicks on links with a click limit
+// are stored right away so that the limit holds across concurrent visitors,
+// all other clicks are buffered and stored in batches. It reports false when
+// the limit was reached before this click.
+func (m *Repository) countClick(link *models.Link) (bool, error) {
+	if link.MaxClicks != nil {
+		counted, err := m.DB.CountLimitedLinkClick(link.ID)
+		if err != nil || !counted {
+			return false, err
+		}
+	} else {
+		m.Clicks.Add(link.ID, 1)
+	}
+
+	link.Clicks++
+
+	return true, nil
+}
+
+// recordClick adds a click to the redirect history. Failures are logged, the
+// visitor is redirected either way.
+func (m *Repository) recordClick(r *http.Request, link *models.Link) {
+	source := r.URL.Query().Get("src")
+	if len(source) > maxSourceLength {
+		source = source[:maxSourceLength]
+	}
+
+	device, browser := parseUserAgent(r.UserAgent())
+
+	redirectHistory := models.RedirectHistory{
+		LinkID:    link.ID,
+		Device:    device,
+		Browser:   browser,
+		IPAddress: utils.ClientIP(r),
+		Source:    source,
+		CreatedAt: time.Now(),
+	}
+
+	_, err := m.DB.InsertRedirectHistory(&redirectHistory)
+	if err != nil {
+		log.Printf("Failed to record click on link %d: %v\n", link.ID, err)
+	}
+}
+
+// redirectCacheControl lets browsers keep permanent redirects for a while,
+// unless every click has to reach us because it counts towards a limit, and
+// never for longer than the link lives. Temporary redirects are not cached.
+// Shared caches are kept out so that clicks still show up in the history.
+func redirectCacheControl(link *models.Link, redirectType int, now time.Time) string {
+	permanent := redirectType == http.StatusMovedPermanently || redirectType == http.StatusPermanentRedirect
+	if !permanent || link.MaxClicks != nil {
+		return "private, no-store"
+	}
+
+	maxAge := permanentRedirectMaxAge
+	if link.ExpiresAt != nil && link.ExpiresAt.Sub(now) < maxAge {
+		maxAge = link.ExpiresAt.Sub(now)
+	}
+
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+}
+
+// shortLinkURL returns the address visitors use for a short link: on the short
+// domain when there is one, on the frontend otherwise
+func (m *Repository) shortLinkURL(shortenURL string) string {
+	if m.App.SHORT_DOMAIN != "" {
+		return fmt.Sprintf("https://%s/%s", m.App.SHORT_DOMAIN, url.PathEscape(shortenURL))
+	}
+
+	return fmt.Sprintf("%s/%s", m.App.FRONTEND_URL, url.PathEscape(shortenURL))
+}
+
+// parseUserAgent makes a rough guess at the device and browser of a visitor,
+// good enough for the analytics pages
+func parseUserAgent(userAgent string) (string, string) {
+	ua := strings.ToLower(userAgent)
+
+	device := "desktop"
+	switch {
+	case ua == "":
+		device = "unknown"
+	case strings.Contains(ua, "bot"), strings.Contains(ua, "spider"), strings.Contains(ua, "crawl"):
+		device = "bot"
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"):
+		device = "tablet"
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "android"):
+		device = "mobile"
+	}
+
+	browser := "other"
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "opr/"), strings.Contains(ua, "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "firefox/"), strings.Contains(ua, "fxios/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome/"), strings.Contains(ua, "crios/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari/"):
+		browser = "Safari"
+	}
+
+	return device, browser
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+// sessionResponse is a session as shown to its user
+type sessionResponse struct {
+	models.Session
+	Current bool `json:"current"`
+}
+
+// AllSessions lists the sessions in which a user is still logged in
+func (m *Repository) AllSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	m.writeSessions(w, r, user.ID)
+}
+
+// DeleteSession logs a user out of one of their sessions
+func (m *Repository) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	m.revokeSession(w, r, user.ID)
+}
+
+// ManagedUserSessions lets staff list the sessions of any user
+func (m *Repository) ManagedUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	m.writeSessions(w, r, user.ID)
+}
+
+// DeleteManagedUserSession lets staff end a session of any user, e.g. after
+// the user reported a lost device
+func (m *Repository) DeleteManagedUserSession(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	m.revokeSession(w, r, user.ID)
+}
+
+func (m *Repository) writeSessions(w http.ResponseWriter, r *http.Request, userID int) {
+	// Sessions that have not been used for longer than a refresh token lives
+	// cannot be resumed anyway
+	sessions, err := m.DB.GetActiveSessions(userID, time.Now().Add(-m.Auth.RefreshExpiry))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	var currentID string
+	if claims, ok := auth.ClaimsFromContext(r.Context()); ok {
+		currentID = claims.SessionID
+	}
+
+	response := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionResponse{
+			Session: session,
+			Current: session.ID == currentID,
+		})
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// revokeSession ends the session in the {sid} path parameter. Its refresh
+// tokens are revoked and its access tokens are rejected from now on.
+func (m *Repository) revokeSession(w http.ResponseWriter, r *http.Request, userID int) {
+	sessionID := chi.URLParam(r, "sid")
+	if sessionID == "" {
+		utils.ErrorJSON(w, errors.New("invalid session id"), http.StatusBadRequest)
+		return
+	}
+
+	err := m.DB.RevokeSession(userID, sessionID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("session not found"), http.StatusNotFound)
+		return
+	}
+
+	m.audit(r, userID, models.AuditSessionRevoked, sessionID)
+
+	if claims, ok := auth.ClaimsFromContext(r.Context()); ok && claims.SessionID == sessionID {
+		http.SetCookie(w, m.Auth.GetExpiredRefreshCookie())
+	}
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
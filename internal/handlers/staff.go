@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+var (
+	errAccountSuspended = errors.New("account is suspended")
+	errLinkDisabled     = errors.New("link has been disabled")
+)
+
+// userSummary is what staff get to see about a user
+type userSummary struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	Role            string     `json:"role"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	TOTPEnabled     bool       `json:"totpEnabled"`
+	SuspendedAt     *time.Time `json:"suspendedAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+}
+
+func newUserSummary(user *models.User) userSummary {
+	return userSummary{
+		ID:              user.ID,
+		Name:            user.Name,
+		Email:           user.Email,
+		Role:            user.Role,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		TOTPEnabled:     user.TOTPEnabledAt != nil,
+		SuspendedAt:     user.SuspendedAt,
+		CreatedAt:       user.CreatedAt,
+	}
+}
+
+// ListUsers returns a page of users, optionally filtered with ?q= on name and email
+func (m *Repository) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultUserPageSize
+	}
+	if limit > maxUserPageSize {
+		limit = maxUserPageSize
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	users, total, err := m.DB.SearchUsers(query, offset, limit)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve users"), http.StatusInternalServerError)
+		return
+	}
+
+	summaries := make([]userSummary, 0, len(users))
+	for i := range users {
+		summaries = append(summaries, newUserSummary(&users[i]))
+	}
+
+	response := map[string]interface{}{
+		"users":  summaries,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// GetManagedUser returns a single user
+func (m *Repository) GetManagedUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, newUserSummary(user))
+}
+
+// UpdateUserRole gives a user another role. Tokens issued with the old role
+// are revoked so that the change applies right away.
+func (m *Repository) UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if !auth.IsValidRole(payload.Role) {
+		utils.ErrorJSON(w, errors.New("invalid role"), http.StatusBadRequest)
+		return
+	}
+
+	if m.isSelf(r, user.ID) {
+		utils.ErrorJSON(w, errors.New("you cannot change your own role"), http.StatusForbidden)
+		return
+	}
+
+	if payload.Role == user.Role {
+		_ = utils.WriteJSON(w, http.StatusOK, newUserSummary(user))
+		return
+	}
+
+	err = m.DB.UpdateUserRole(user.ID, payload.Role)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to update role"), http.StatusInternalServerError)
+		return
+	}
+
+	m.audit(r, user.ID, models.AuditRoleChanged, fmt.Sprintf("%s -> %s", user.Role, payload.Role))
+
+	err = m.Auth.Revocations.RevokeUserTokens(user.ID, time.Now())
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to revoke tokens"), http.StatusInternalServerError)
+		return
+	}
+
+	user.Role = payload.Role
+
+	_ = utils.WriteJSON(w, http.StatusOK, newUserSummary(user))
+}
+
+// SuspendUser blocks a user from logging in and logs them out everywhere.
+// Their links stop redirecting and their API tokens stop working until they
+// are reactivated.
+func (m *Repository) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if !m.canManage(w, r, user) {
+		return
+	}
+
+	if user.SuspendedAt == nil {
+		now := time.Now()
+
+		err = m.DB.SetUserSuspended(user.ID, &now)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to suspend user"), http.StatusInternalServerError)
+			return
+		}
+
+		m.audit(r, user.ID, models.AuditUserSuspended, payload.Reason)
+
+		user.SuspendedAt = &now
+	}
+
+	err = m.revokeAllSessions(user.ID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to revoke sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, newUserSummary(user))
+}
+
+// ReactivateUser lifts a suspension
+func (m *Repository) ReactivateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUserFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if !m.canManage(w, r, user) {
+		return
+	}
+
+	if user.SuspendedAt != nil {
+		err := m.DB.SetUserSuspended(user.ID, nil)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to reactivate user"), http.StatusInternalServerError)
+			return
+		}
+
+		m.audit(r, user.ID, models.AuditUserReactivated, "")
+
+		user.SuspendedAt = nil
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, newUserSummary(user))
+}
+
+// DisableLink stops an abusive link from redirecting. Its owner cannot
+// enable it again.
+func (m *Repository) DisableLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := m.managedLinkFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if link.DisabledAt == nil {
+		now := time.Now()
+
+		err = m.DB.SetLinkDisabled(link.ID, &now)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to disable link"), http.StatusInternalServerError)
+			return
+		}
+
+		m.audit(r, link.UserID, models.AuditLinkDisabled, fmt.Sprintf("link %s: %s", link.PublicID, payload.Reason))
+
+		link.DisabledAt = &now
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, link)
+}
+
+// EnableLink lets a disabled link redirect again
+func (m *Repository) EnableLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := m.managedLinkFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if link.DisabledAt != nil {
+		err := m.DB.SetLinkDisabled(link.ID, nil)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to enable link"), http.StatusInternalServerError)
+			return
+		}
+
+		m.audit(r, link.UserID, models.AuditLinkEnabled, fmt.Sprintf("link %s", link.PublicID))
+
+		link.DisabledAt = nil
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, link)
+}
+
+// managedUserFromPath loads the user named by {userID} on staff routes
+func (m *Repository) managedUserFromPath(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// managedLinkFromPath loads the link named by {linkID} on staff routes
+func (m *Repository) managedLinkFromPath(w http.ResponseWriter, r *http.Request) (*models.Link, bool) {
+	publicID := chi.URLParam(r, "linkID")
+	if _, err := uuid.Parse(publicID); err != nil {
+		utils.ErrorJSON(w, errors.New("invalid link id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	link, err := m.DB.GetLinkByPublicID(publicID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve link"), http.StatusInternalServerError)
+		return nil, false
+	}
+	if link == nil {
+		utils.ErrorJSON(w, errors.New("link not found"), http.StatusNotFound)
+		return nil, false
+	}
+
+	return link, true
+}
+
+// canManage stops staff from acting on themselves, and on other staff unless
+// they are allowed to manage roles
+func (m *Repository) canManage(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	if m.isSelf(r, user.ID) {
+		utils.ErrorJSON(w, errors.New("you cannot do this to your own account"), http.StatusForbidden)
+		return false
+	}
+
+	claims, _ := auth.ClaimsFromContext(r.Context())
+	if user.Role != auth.RoleUser && (claims == nil || !claims.HasPermission(auth.PermissionRolesManage)) {
+		utils.ErrorJSON(w, errors.New("only administrators can do this to staff accounts"), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (m *Repository) isSelf(r *http.Request, userID int) bool {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		return false
+	}
+
+	subjectID, err := claims.UserID()
+
+	return err == nil && subjectID == userID
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+func (m *Repository) AllAPITokens(w http.ResponseWriter, r *http.Request) {
+	id, _ := utils.GetIDFromURL(r.URL.Path)
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := m.DB.GetAllAPITokens(userID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to retrieve tokens"), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+func (m *Repository) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := utils.GetIDFromURL(r.URL.Path)
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+
+	err = utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if len(payload.Name) < 3 || len(payload.Name) > 64 {
+		utils.ErrorJSON(w, errors.New("name must be between 3 and 64 characters"), http.StatusBadRequest)
+		return
+	}
+
+	if len(payload.Scopes) == 0 {
+		utils.ErrorJSON(w, errors.New("at least one scope is required"), http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range payload.Scopes {
+		if !auth.IsValidScope(scope) {
+			utils.ErrorJSON(w, fmt.Errorf("invalid scope: %s", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if payload.ExpiresAt != nil && payload.ExpiresAt.Before(time.Now()) {
+		utils.ErrorJSON(w, errors.New("expiresAt must be in the future"), http.StatusBadRequest)
+		return
+	}
+
+	plainToken, err := auth.GenerateAPIToken()
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to generate token"), http.StatusInternalServerError)
+		return
+	}
+
+	token := models.APIToken{
+		UserID:    userID,
+		Name:      payload.Name,
+		Prefix:    plainToken[:len(auth.APITokenPrefix)+6],
+		TokenHash: utils.HashToken(plainToken),
+		Scopes:    payload.Scopes,
+		ExpiresAt: payload.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	err = m.DB.InsertAPIToken(&token)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to insert token"), http.StatusInternalServerError)
+		return
+	}
+
+	// The plain token is only ever shown once
+	response := struct {
+		models.APIToken
+		Token string `json:"token"`
+	}{
+		APIToken: token,
+		Token:    plainToken,
+	}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func (m *Repository) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := utils.GetIDFromURL(r.URL.Path)
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid token id"), http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.DeleteAPIToken(userID, tokenID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to delete token"), http.StatusInternalServerError)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Token successfully deleted!")
+}
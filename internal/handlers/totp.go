@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const (
+	totpIssuer        = "ByteURL"
+	recoveryCodeCount = 10
+)
+
+func (m *Repository) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		utils.ErrorJSON(w, errors.New("two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to generate secret"), http.StatusInternalServerError)
+		return
+	}
+
+	err = m.DB.SetUserTOTPSecret(user.ID, secret)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to store secret"), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{
+		"secret": secret,
+		"uri":    auth.TOTPProvisioningURI(totpIssuer, user.Email, secret),
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func (m *Repository) VerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		utils.ErrorJSON(w, errors.New("two-factor authentication is already enabled"), http.StatusConflict)
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		utils.ErrorJSON(w, errors.New("two-factor enrollment has not been started"), http.StatusBadRequest)
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(user.TOTPSecret, payload.Code, time.Now())
+	if !valid {
+		utils.ErrorJSON(w, errors.New("invalid code"), http.StatusBadRequest)
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to generate recovery codes"), http.StatusInternalServerError)
+		return
+	}
+
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, utils.HashToken(code))
+	}
+
+	err = m.DB.EnableUserTOTP(user.ID, step, hashes)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to enable two-factor authentication"), http.StatusInternalServerError)
+		return
+	}
+
+	// The plain recovery codes are only ever shown once
+	response := map[string][]string{"recoveryCodes": codes}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func (m *Repository) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var payload struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if user.TOTPEnabledAt == nil {
+		utils.ErrorJSON(w, errors.New("two-factor authentication is not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	fullUser, err := m.DB.GetUserByEmail(user.Email)
+	if err != nil || fullUser == nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusBadRequest)
+		return
+	}
+
+	valid, err := fullUser.PasswordMathes(payload.Password)
+	if !valid || err != nil {
+		utils.ErrorJSON(w, errors.New("invalid password"), http.StatusBadRequest)
+		return
+	}
+
+	valid, err = m.checkSecondFactor(user, payload.Code, payload.RecoveryCode)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify code"), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		utils.ErrorJSON(w, errors.New("invalid code"), http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.DisableUserTOTP(user.ID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to disable two-factor authentication"), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// LoginTOTP is the second step of a login for users with two-factor
+// authentication. It exchanges the token returned by Login and a TOTP or
+// recovery code for the usual login response.
+func (m *Repository) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	userID, err := m.Auth.VerifyMFAToken(payload.MFAToken)
+	if err != nil {
+		utils.ErrorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusUnauthorized)
+		return
+	}
+
+	if user.TOTPEnabledAt == nil {
+		utils.ErrorJSON(w, errors.New("two-factor authentication is not enabled"), http.StatusBadRequest)
+		return
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	accountKey := auth.AccountLoginKey(user.Email)
+	ipKey := auth.IPLoginKey(utils.ClientIP(r))
+
+	if !m.checkLoginAllowed(w, accountKey, ipKey) {
+		return
+	}
+
+	valid, err := m.checkSecondFactor(user, payload.Code, payload.RecoveryCode)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify code"), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		_, err = m.Auth.LoginFailed(accountKey, ipKey)
+		if err != nil {
+			utils.ErrorJSON(w, errors.New("failed to record login attempt"), http.StatusInternalServerError)
+			return
+		}
+
+		utils.ErrorJSON(w, errors.New("invalid code"), http.StatusUnauthorized)
+		return
+	}
+
+	err = m.Auth.ResetLoginFailures(accountKey)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to reset login attempts"), http.StatusInternalServerError)
+		return
+	}
+
+	m.writeNewSession(w, r, user)
+}
+
+// checkSecondFactor accepts either a TOTP code, which may only be used once,
+// or an unused recovery code
+func (m *Repository) checkSecondFactor(user *models.User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return m.DB.ConsumeRecoveryCode(user.ID, utils.HashToken(auth.NormalizeRecoveryCode(recoveryCode)))
+	}
+
+	step, valid := auth.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if !valid {
+		return false, nil
+	}
+
+	return m.DB.UseTOTPStep(user.ID, step)
+}
+
+// userFromPath loads the user referenced by /users/{id}, writing an error
+// response when it cannot
+func (m *Repository) userFromPath(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, _ := utils.GetIDFromURL(r.URL.Path)
+
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return user, true
+}
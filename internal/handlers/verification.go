@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/mailer"
+	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+const emailVerificationExpiry = time.Hour * 48
+
+func (m *Repository) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	plainToken := r.URL.Query().Get("token")
+	if plainToken == "" {
+		utils.ErrorJSON(w, errors.New("token cannot be empty"), http.StatusBadRequest)
+		return
+	}
+
+	token, err := m.DB.ConsumeUserToken(models.TokenScopeEmailVerification, utils.HashToken(plainToken))
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify token"), http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		utils.ErrorJSON(w, errors.New("invalid or expired verification token"), http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.MarkUserEmailVerified(token.UserID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("failed to verify email"), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{"message": "success"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+func (m *Repository) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		utils.ErrorJSON(w, err)
+		return
+	}
+
+	if !utils.IsValidEmail(payload.Email) {
+		utils.ErrorJSON(w, errors.New("invalid email address"), http.StatusBadRequest)
+		return
+	}
+
+	// The account is looked up and the mail sent in the background so that
+	// neither the answer nor the time it takes tell whether the email belongs
+	// to an unverified account
+	m.runInBackground(func() {
+		user, err := m.DB.GetUserByEmail(payload.Email)
+		if err != nil {
+			log.Printf("Failed to look up user for verification email: %v\n", err)
+			return
+		}
+		if user == nil || user.EmailVerifiedAt != nil {
+			return
+		}
+
+		err = m.sendVerificationEmail(user)
+		if err != nil {
+			log.Printf("Failed to send verification email: %v\n", err)
+		}
+	})
+
+	response := map[string]string{"message": "if an unverified account exists for this email, a verification link has been sent"}
+
+	_ = utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// sendVerificationEmail replaces any pending verification token for the user
+// and emails a new verification link
+func (m *Repository) sendVerificationEmail(user *models.User) error {
+	err := m.DB.InvalidateUserTokens(user.ID, models.TokenScopeEmailVerification)
+	if err != nil {
+		return err
+	}
+
+	token, err := m.createUserToken(user.ID, models.TokenScopeEmailVerification, emailVerificationExpiry)
+	if err != nil {
+		return err
+	}
+
+	verifyURL := fmt.Sprintf("%s/verify-email?token=%s", m.App.FRONTEND_URL, url.QueryEscape(token))
+
+	m.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your ByteURL email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm that this is your email address by opening the link below:\n\n%s\n\nThe link expires in %d hours.\n",
+			user.Name, verifyURL, int(emailVerificationExpiry.Hours())),
+	})
+
+	return nil
+}
+
+// canCreateLinks writes an error and returns false when the user has to verify
+// their email before creating links
+func (m *Repository) canCreateLinks(w http.ResponseWriter, userID int) bool {
+	if !m.App.REQUIRE_EMAIL_VERIFICATION {
+		return true
+	}
+
+	user, err := m.DB.GetUserByID(userID)
+	if err != nil {
+		utils.ErrorJSON(w, errors.New("invalid user"), http.StatusBadRequest)
+		return false
+	}
+
+	if user.EmailVerifiedAt == nil {
+		utils.ErrorJSON(w, errors.New("email address must be verified before creating links"), http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
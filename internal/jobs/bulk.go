@@ -0,0 +1,30 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+)
+
+// bulkJobInterrupted is the error of bulk jobs that stopped without finishing
+const bulkJobInterrupted = "job was interrupted, upload the remaining rows again"
+
+// FailStaleBulkJobs returns a job that marks bulk jobs as failed once they
+// have not saved any progress for staleAfter, e.g. because the server was
+// restarted while they were running
+func FailStaleBulkJobs(db repository.DatabaseRepo, staleAfter time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		failed, err := db.FailStaleBulkJobs(time.Now().Add(-staleAfter), bulkJobInterrupted)
+		if err != nil {
+			return err
+		}
+
+		if failed > 0 {
+			log.Printf("Marked %d interrupted bulk jobs as failed\n", failed)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,14 @@
+package jobs
+
+import (
+	"context"
+
+	"github.com/elidotexe/backend_byteurl/internal/clicks"
+)
+
+// FlushClicks returns a job that stores the clicks buffered by counter
+func FlushClicks(counter *clicks.Counter) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return counter.Flush()
+	}
+}
@@ -0,0 +1,26 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+)
+
+// MarkFinishedLinks returns a job that marks links as expired or exhausted
+// once they have hit one of their limits
+func MarkFinishedLinks(db repository.DatabaseRepo) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		marked, err := db.MarkFinishedLinks(time.Now())
+		if err != nil {
+			return err
+		}
+
+		if marked > 0 {
+			log.Printf("Marked %d links as finished\n", marked)
+		}
+
+		return nil
+	}
+}
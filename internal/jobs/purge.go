@@ -0,0 +1,26 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/repository"
+)
+
+// PurgeDeletedUsers returns a job that removes accounts, with their links and
+// redirect history, once they have been deleted for longer than gracePeriod
+func PurgeDeletedUsers(db repository.DatabaseRepo, gracePeriod time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		purged, err := db.PurgeDeletedUsers(time.Now().Add(-gracePeriod))
+		if err != nil {
+			return err
+		}
+
+		if purged > 0 {
+			log.Printf("Purged %d deleted accounts\n", purged)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// fileMailer writes every message to an .eml file in dir, or only logs it
+// when dir is empty. It is meant for local development.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]`)
+
+func NewFileMailer(dir, from string) *fileMailer {
+	return &fileMailer{
+		dir:  dir,
+		from: from,
+	}
+}
+
+func (m *fileMailer) Send(msg Message) error {
+	if m.dir == "" {
+		log.Printf("Mail to %s: %s\n%s\n", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	err := os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	path := filepath.Join(m.dir, name)
+
+	err = os.WriteFile(path, buildMessage(m.from, msg), 0o600)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Mail written to", path)
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package mailer
+
+import (
+	"fmt"
+
+	"github.com/elidotexe/backend_byteurl/internal/config"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns the mailer selected by MAIL_DRIVER. It defaults to the file
+// driver so that the app can run locally without an SMTP server.
+func New(app *config.AppConfig) (Mailer, error) {
+	switch app.MAIL_DRIVER {
+	case "smtp":
+		return NewSMTPMailer(app.SMTP_HOST, app.SMTP_PORT, app.SMTP_USERNAME, app.SMTP_PASSWORD, app.MAIL_FROM), nil
+	case "", "file", "log":
+		return NewFileMailer(app.MAIL_DIR, app.MAIL_FROM), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver: %s", app.MAIL_DRIVER)
+	}
+}
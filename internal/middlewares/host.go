@@ -0,0 +1,27 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Host sends requests for the given host to h and all other requests on to
+// the next handler. The port of the request is ignored.
+func Host(host string, h http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestHost := r.Host
+			if hostname, _, err := net.SplitHostPort(requestHost); err == nil {
+				requestHost = hostname
+			}
+
+			if strings.EqualFold(requestHost, host) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
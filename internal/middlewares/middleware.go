@@ -2,9 +2,11 @@ package middlewares
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/elidotexe/backend_byteurl/internal/auth"
 	"github.com/elidotexe/backend_byteurl/internal/config"
+	"github.com/go-chi/chi/v5"
 )
 
 type AuthMiddleware struct {
@@ -22,11 +24,11 @@ func NewAuthMiddleware(app *config.AppConfig, authInstance *auth.Auth) *AuthMidd
 func (a *AuthMiddleware) EnableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Unlock-Token")
 			w.WriteHeader(http.StatusNoContent)
 			return
 		} else {
@@ -37,12 +39,123 @@ func (a *AuthMiddleware) EnableCORS(next http.Handler) http.Handler {
 
 func (a *AuthMiddleware) RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _, err := a.auth.GetTokenFromHeaderAndVerify(w, r)
+		_, claims, err := a.auth.GetTokenFromHeaderAndVerify(w, r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
+		next.ServeHTTP(w, r.WithContext(auth.ContextWithClaims(r.Context(), claims)))
+	})
+}
+
+// RequireSession only lets through access tokens from a login, so that
+// personal API tokens cannot reach routes that have no scope
+func (a *AuthMiddleware) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := auth.ClaimsFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if claims.Type != auth.TokenTypeAccess {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireScope rejects API tokens that were not granted the given scope
+func (a *AuthMiddleware) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := auth.ClaimsFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if !claims.HasScope(scope) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireOwner rejects requests for a /users/{id} resource that does not
+// belong to the authenticated user. It must run after RequireAuth, on routes
+// with an {id} parameter.
+func (a *AuthMiddleware) RequireOwner(next http.Handler) http.Handler {
+	return a.RequireOwnerOr("")(next)
+}
+
+// RequireOwnerOr is like RequireOwner, but also lets in principals whose role
+// grants the given permission, e.g. staff looking at somebody's links
+func (a *AuthMiddleware) RequireOwnerOr(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := auth.ClaimsFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// Routes without a numeric {id} have no owner to check against,
+			// so they are refused rather than let through
+			userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+			if err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			if !canAccessUser(claims, userID, permission) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// canAccessUser reports whether the principal may act on the given user's
+// resources: they have to be the owner, or hold permission when one is given
+func canAccessUser(claims *auth.Claims, userID int, permission string) bool {
+	subjectID, err := claims.UserID()
+	if err != nil {
+		return false
+	}
+
+	if subjectID == userID {
+		return true
+	}
+
+	return permission != "" && claims.HasPermission(permission)
+}
+
+// RequirePermission rejects principals whose role does not grant the given
+// permission. It must run after RequireAuth.
+func (a *AuthMiddleware) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := auth.ClaimsFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if !claims.HasPermission(permission) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package middlewares
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/auth"
+	"github.com/elidotexe/backend_byteurl/internal/utils"
+)
+
+// rateLimiter is a fixed window counter kept in process memory
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	hits  int
+}
+
+// RateLimit allows at most limit requests per window for each caller. Callers
+// are identified by their user id when authenticated and by IP otherwise.
+// Every use of RateLimit keeps its own counters.
+func RateLimit(limit int, window time.Duration) func(http.Handler) http.Handler {
+	return RateLimitBy(limit, window, rateLimitKey)
+}
+
+// RateLimitBy is RateLimit with a custom function that identifies the caller
+func RateLimitBy(limit int, window time.Duration, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	limiter := &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			retryAfter := limiter.allow(key(r), time.Now())
+			if retryAfter > 0 {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allow counts a request and returns how long the caller has to wait when it
+// is over the limit
+func (l *rateLimiter) allow(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Drop finished windows every now and then so the map does not grow forever
+	if now.Sub(l.lastSweep) > l.window {
+		for k, win := range l.windows {
+			if now.Sub(win.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	win, ok := l.windows[key]
+	if !ok || now.Sub(win.start) >= l.window {
+		win = &rateWindow{start: now}
+		l.windows[key] = win
+	}
+
+	if win.hits >= l.limit {
+		return win.start.Add(l.window).Sub(now)
+	}
+
+	win.hits++
+
+	return 0
+}
+
+func rateLimitKey(r *http.Request) string {
+	if claims, ok := auth.ClaimsFromContext(r.Context()); ok {
+		return "user:" + claims.Subject
+	}
+
+	return "ip:" + utils.ClientIP(r)
+}
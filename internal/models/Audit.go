@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// AuditEvent records a security relevant change to an account. ActorID is the
+// user who made the change, which is not always the owner of the account.
+type AuditEvent struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"userId" gorm:"index"`
+	ActorID   int       `json:"actorId"`
+	Action    string    `json:"action" gorm:"index"`
+	Details   string    `json:"details"`
+	IPAddress string    `json:"ipAddress"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	AuditPasswordChanged      = "password.changed"
+	AuditEmailChangeRequested = "email.change_requested"
+	AuditEmailChanged         = "email.changed"
+	AuditAccountExported      = "account.exported"
+	AuditAccountDeleted       = "account.deleted"
+	AuditAccountRestored      = "account.restored"
+	AuditRoleChanged          = "role.changed"
+	AuditUserSuspended        = "user.suspended"
+	AuditUserReactivated      = "user.reactivated"
+	AuditLinkDisabled         = "link.disabled"
+	AuditLinkEnabled          = "link.enabled"
+	AuditSessionRevoked       = "session.revoked"
+)
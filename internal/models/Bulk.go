@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+const (
+	BulkJobPending  = "pending"
+	BulkJobRunning  = "running"
+	BulkJobFinished = "finished"
+	BulkJobFailed   = "failed"
+)
+
+// BulkJob tracks a bulk upload of links that is processed in the background.
+// Results are only stored once the whole upload has been processed.
+type BulkJob struct {
+	ID        string       `json:"id,omitempty" gorm:"primaryKey"`
+	UserID    int          `json:"userId" gorm:"index"`
+	Status    string       `json:"status"`
+	Total     int          `json:"total"`
+	Processed int          `json:"processed"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results,omitempty" gorm:"serializer:json"`
+	Error     string       `json:"error,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+	// UpdatedAt changes with every saved batch, jobs that stop updating were
+	// interrupted and are marked as failed
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+// BulkResult is the outcome of one row of a bulk upload. Row counts from 1
+// and does not include a CSV header.
+type BulkResult struct {
+	Row        int            `json:"row"`
+	LinkID     string         `json:"linkId,omitempty"`
+	Number     int            `json:"number,omitempty"`
+	ShortenURL string         `json:"shortenUrl,omitempty"`
+	Errors     []BulkRowError `json:"errors,omitempty"`
+}
+
+type BulkRowError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// RefreshToken is a single opaque refresh token. Tokens that are rotated from
+// one another share a FamilyID so that the whole chain can be revoked at once.
+type RefreshToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userId" gorm:"index"`
+	FamilyID  string     `json:"familyId" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Session is a single login. Its ID is the FamilyID of the refresh tokens and
+// the sid claim of the access tokens issued for it.
+type Session struct {
+	ID         string     `json:"id" gorm:"primaryKey"`
+	UserID     int        `json:"userId" gorm:"index"`
+	UserAgent  string     `json:"userAgent"`
+	IPAddress  string     `json:"ipAddress"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastSeenAt time.Time  `json:"lastSeenAt"`
+	RevokedAt  *time.Time `json:"-"`
+}
+
+// RevokedToken is an access token that was revoked before it expired. It only
+// needs to be kept until ExpiresAt, after which the token is rejected anyway.
+type RevokedToken struct {
+	JTI       string    `json:"jti" gorm:"primaryKey"`
+	UserID    int       `json:"userId" gorm:"index"`
+	ExpiresAt time.Time `json:"expiresAt" gorm:"index"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserTokenRevocation invalidates every access token issued to a user up to
+// and including RevokedBefore
+type UserTokenRevocation struct {
+	UserID        int       `json:"userId" gorm:"primaryKey;autoIncrement:false"`
+	RevokedBefore time.Time `json:"revokedBefore"`
+}
+
+// RecoveryCode is a single-use code that can replace a TOTP code when the
+// user has lost their authenticator
+type RecoveryCode struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userId" gorm:"index"`
+	CodeHash  string     `json:"-" gorm:"index"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// APIToken is a long-lived personal access token for programmatic access.
+// Only the hash of the token is stored, Prefix helps users tell tokens apart.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"userId" gorm:"index"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	TokenHash  string     `json:"-" gorm:"uniqueIndex"`
+	Scopes     []string   `json:"scopes" gorm:"serializer:json"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// LoginAttempt counts recent failed logins for a key, which is either an
+// account ("account:<email>") or a client ("ip:<address>")
+type LoginAttempt struct {
+	Key          string     `json:"key" gorm:"primaryKey"`
+	Failures     int        `json:"failures"`
+	LastFailedAt time.Time  `json:"lastFailedAt"`
+	LockedUntil  *time.Time `json:"lockedUntil"`
+}
@@ -4,39 +4,138 @@ import (
 	"errors"
 	"time"
 
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 type RedirectHistory struct {
-	ID        int       `json:"id"`
-	LinkID    int       `json:"linkId" gorm:"index" validate:"required"`
-	Device    string    `json:"device"`
-	Browser   string    `json:"browser"`
-	IPAddress string    `json:"ipAddress"`
-	Location  string    `json:"location"`
+	ID     int `json:"-"`
+	LinkID int `json:"-" gorm:"index" validate:"required"`
+	// LinkPublicID is only loaded where the history is listed apart from its links
+	LinkPublicID string `json:"linkId,omitempty" gorm:"->;-:migration"`
+	Device       string `json:"device"`
+	Browser      string `json:"browser"`
+	IPAddress    string `json:"ipAddress"`
+	Location     string `json:"location"`
+	// Source tells where the visit came from, e.g. "qr" for scanned QR codes
+	Source    string    `json:"source"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+// Link is identified by its database id internally and by PublicID in the
+// API. Number counts the links of a user, for showing small numbers.
 type Link struct {
-	ID              int                `json:"id"`
+	ID              int                `json:"-"`
+	PublicID        string             `json:"id" gorm:"type:uuid;uniqueIndex"`
+	Number          int                `json:"number" gorm:"not null;default:0"`
 	UserID          int                `json:"userId" gorm:"index" validate:"required"`
 	Title           string             `json:"title"`
 	OriginalURL     string             `json:"originalUrl" validate:"required,url"`
-	ShortenURL      string             `json:"shortenUrl"`
+	ShortenURL      string             `json:"shortenUrl" gorm:"uniqueIndex"`
 	Clicks          int                `json:"clicks" sql:"default:0"`
+	DisabledAt      *time.Time         `json:"disabledAt"`
+	ExpiresAt       *time.Time         `json:"expiresAt"`
+	MaxClicks       *int               `json:"maxClicks"`
+	FallbackURL     string             `json:"fallbackUrl"`
+	RedirectType    int                `json:"redirectType" gorm:"not null;default:302"`
+	Status          string             `json:"status" gorm:"not null;default:active;index"`
+	PasswordHash    string             `json:"-"`
+	Protected       bool               `json:"protected" gorm:"-"`
 	RedirectHistory []*RedirectHistory `json:"redirectHistory" gorm:"foreignKey:LinkID;references:ID"`
 	CreatedAt       time.Time          `json:"createdAt"`
 	UpdatedAt       time.Time          `json:"updatedAt"`
 }
 
+const (
+	LinkStatusActive    = "active"
+	LinkStatusExpired   = "expired"
+	LinkStatusExhausted = "exhausted"
+)
+
+// CurrentStatus works out the status of the link from its limits. The stored
+// Status is kept up to date by a background job and can lag behind.
+func (l *Link) CurrentStatus(now time.Time) string {
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return LinkStatusExpired
+	}
+
+	if l.MaxClicks != nil && l.Clicks >= *l.MaxClicks {
+		return LinkStatusExhausted
+	}
+
+	return LinkStatusActive
+}
+
+// BeforeCreate gives new links their public id
+func (l *Link) BeforeCreate(tx *gorm.DB) error {
+	if l.PublicID == "" {
+		l.PublicID = uuid.NewString()
+	}
+
+	return nil
+}
+
+// AfterFind makes sure that loaded links never show a stale status
+func (l *Link) AfterFind(tx *gorm.DB) error {
+	l.Status = l.CurrentStatus(time.Now())
+	l.Protected = l.PasswordHash != ""
+	return nil
+}
+
 type User struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	Password        string     `json:"password"`
+	TOTPSecret      string     `json:"-"`
+	TOTPEnabledAt   *time.Time `json:"totpEnabledAt"`
+	TOTPLastStep    int64      `json:"-"`
+	Role            string     `json:"role" gorm:"not null;default:user"`
+	SuspendedAt     *time.Time `json:"suspendedAt"`
+	Links           []*Link    `json:"links" gorm:"foreignKey:UserID;references:ID"`
+	// LastLinkNumber is the Number of the user's newest link
+	LastLinkNumber int       `json:"-" gorm:"not null;default:0"`
+	CreatedAt      time.Time `json:"-"`
+	UpdatedAt      time.Time `json:"-"`
+
+	// DeletedAt is set when the user deletes their account. The account is
+	// purged for good once the grace period has passed.
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// Identity links a user to an account at an external identity provider
+type Identity struct {
 	ID        int       `json:"id"`
-	Name      string    `json:"name"`
+	UserID    int       `json:"userId" gorm:"index"`
+	Provider  string    `json:"provider" gorm:"uniqueIndex:idx_identities_provider_subject"`
+	Subject   string    `json:"subject" gorm:"uniqueIndex:idx_identities_provider_subject"`
 	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	Links     []*Link   `json:"links" gorm:"foreignKey:UserID;references:ID"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	TokenScopePasswordReset     = "password_reset"
+	TokenScopeEmailVerification = "email_verification"
+	TokenScopeAccountUnlock     = "account_unlock"
+	TokenScopeEmailChange       = "email_change"
+	TokenScopeAccountRestore    = "account_restore"
+	TokenScopeMagicLogin        = "magic_login"
+)
+
+// UserToken is a single-use token that is emailed to a user. Only the hash
+// of the token is stored. Data holds scope specific values, such as the new
+// address of an email change.
+type UserToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userId" gorm:"index"`
+	Scope     string     `json:"scope" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex"`
+	Data      string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
 }
 
 // HashPassword takes a plain text password and returns a hashed password
@@ -63,3 +162,19 @@ func (u *User) PasswordMathes(plainText string) (bool, error) {
 
 	return true, nil
 }
+
+// PasswordMatches compares a plain text password with the password of a
+// protected link
+func (l *Link) PasswordMatches(plainText string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(plainText))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
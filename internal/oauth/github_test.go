@@ -0,0 +1,59 @@
+package oauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/elidotexe/backend_byteurl/internal/oauth/oauthtest"
+)
+
+func newTestGitHubProvider(idp *oauthtest.IdP) Provider {
+	return NewGitHubProvider(ProviderConfig{
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  testRedirectURL,
+		AuthURL:      idp.URL + "/authorize",
+		TokenURL:     idp.URL + "/token",
+		APIURL:       idp.URL,
+	})
+}
+
+func TestGitHubExchange(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(oauthtest.Login{Subject: "42", Email: "ada@example.com", EmailVerified: true, Name: "Ada"})
+
+	provider := newTestGitHubProvider(idp)
+	code, verifier := login(t, idp, provider, "")
+
+	identity, err := provider.Exchange(context.Background(), code, verifier, "")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	// The primary email is used, not the first one in the list
+	want := Identity{Provider: "github", Subject: "42", Email: "ada@example.com", EmailVerified: true, Name: "Ada"}
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+}
+
+func TestGitHubExchangeReportsUnverifiedEmail(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(oauthtest.Login{Subject: "42", Email: "ada@example.com", EmailVerified: false, Name: "Ada"})
+
+	provider := newTestGitHubProvider(idp)
+	code, verifier := login(t, idp, provider, "")
+
+	identity, err := provider.Exchange(context.Background(), code, verifier, "")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	if identity.EmailVerified {
+		t.Error("identity has a verified email, GitHub did not verify it")
+	}
+}
@@ -0,0 +1,294 @@
+// Package oauthtest runs a local identity provider for tests. It speaks
+// enough OpenID Connect for discovery, id_token verification and the
+// authorization code flow with PKCE, and serves the parts of the GitHub API
+// that the GitHub provider reads.
+package oauthtest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const keyID = "oauthtest"
+
+// Login is the user that logs in at the identity provider
+type Login struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+
+	// Nonce replaces the nonce of the authorization request in the id_token
+	// when it is set, like a replayed id_token would
+	Nonce string
+}
+
+// grant is an authorization code or access token handed out by the IdP
+type grant struct {
+	login     Login
+	clientID  string
+	nonce     string
+	challenge string
+}
+
+// IdP is an identity provider on a local test server
+type IdP struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	login  Login
+	codes  map[string]grant
+	tokens map[string]grant
+}
+
+// NewIdP starts an identity provider. Callers should Close it when done.
+func NewIdP() *IdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("oauthtest: cannot generate key: %v", err))
+	}
+
+	p := &IdP{
+		key:    key,
+		codes:  make(map[string]grant),
+		tokens: make(map[string]grant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/user", p.githubUser)
+	mux.HandleFunc("/user/emails", p.githubEmails)
+
+	p.Server = httptest.NewServer(mux)
+
+	return p
+}
+
+// SetLogin sets the user that logs in with the next authorization request
+func (p *IdP) SetLogin(login Login) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.login = login
+}
+
+// Authorize follows an authorization URL as a browser would, with the user
+// set by SetLogin already logged in. It returns the URL the IdP redirects
+// back to, which carries the code and the state.
+func (p *IdP) Authorize(authCodeURL string) (*url.URL, error) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(authCodeURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("authorize returned %s", resp.Status)
+	}
+
+	return url.Parse(resp.Header.Get("Location"))
+}
+
+func (p *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   encode(p.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "unsupported authorization request", http.StatusBadRequest)
+		return
+	}
+
+	redirectURL, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURL.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	p.mu.Lock()
+	p.codes[code] = grant{
+		login:     p.login,
+		clientID:  query.Get("client_id"),
+		nonce:     query.Get("nonce"),
+		challenge: query.Get("code_challenge"),
+	}
+	p.mu.Unlock()
+
+	values := redirectURL.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirectURL.RawQuery = values.Encode()
+
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+func (p *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	code := r.PostForm.Get("code")
+
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	nonce := g.nonce
+	if g.login.Nonce != "" {
+		nonce = g.login.Nonce
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            p.URL,
+		"sub":            g.login.Subject,
+		"aud":            g.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute * 5).Unix(),
+		"nonce":          nonce,
+		"email":          g.login.Email,
+		"email_verified": g.login.EmailVerified,
+		"name":           g.login.Name,
+	})
+	idToken.Header["kid"] = keyID
+
+	signed, err := idToken.SignedString(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	accessToken := randomString()
+
+	p.mu.Lock()
+	p.tokens[accessToken] = g
+	p.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+// bearer returns the grant of the access token a request was made with
+func (p *IdP) bearer(r *http.Request) (grant, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	g, ok := p.tokens[token]
+	return g, ok
+}
+
+func (p *IdP) githubUser(w http.ResponseWriter, r *http.Request) {
+	g, ok := p.bearer(r)
+	if !ok {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return
+	}
+
+	var id int64
+	fmt.Sscan(g.login.Subject, &id)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":    id,
+		"login": strings.ToLower(strings.ReplaceAll(g.login.Name, " ", "")),
+		"name":  g.login.Name,
+	})
+}
+
+func (p *IdP) githubEmails(w http.ResponseWriter, r *http.Request) {
+	g, ok := p.bearer(r)
+	if !ok {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, []map[string]interface{}{
+		{"email": "other@example.com", "primary": false, "verified": true},
+		{"email": g.login.Email, "primary": true, "verified": g.login.EmailVerified},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
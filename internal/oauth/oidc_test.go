@@ -0,0 +1,164 @@
+package oauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/elidotexe/backend_byteurl/internal/oauth/oauthtest"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testClientID    = "byteurl"
+	testRedirectURL = "https://api.byteurl.test/api/oauth/test/callback"
+)
+
+// login runs the authorization code flow against the IdP and returns the code
+// and the verifier that go with it
+func login(t *testing.T, idp *oauthtest.IdP, provider Provider, nonce string) (string, string) {
+	t.Helper()
+
+	verifier := oauth2.GenerateVerifier()
+
+	callback, err := idp.Authorize(provider.AuthCodeURL("state", nonce, verifier))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	if got := callback.Query().Get("state"); got != "state" {
+		t.Fatalf("state = %q, want %q", got, "state")
+	}
+
+	return callback.Query().Get("code"), verifier
+}
+
+func newTestOIDCProvider(t *testing.T, idp *oauthtest.IdP) Provider {
+	t.Helper()
+
+	provider, err := NewOIDCProvider(context.Background(), "test", ProviderConfig{
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  testRedirectURL,
+		IssuerURL:    idp.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+
+	return provider
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada"})
+
+	provider := newTestOIDCProvider(t, idp)
+	code, verifier := login(t, idp, provider, "nonce-1")
+
+	identity, err := provider.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	want := Identity{Provider: "test", Subject: "user-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada"}
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+}
+
+func TestOIDCExchangeRejectsWrongNonce(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	// The IdP returns an id_token that was issued for another login
+	idp.SetLogin(oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true, Nonce: "replayed"})
+
+	provider := newTestOIDCProvider(t, idp)
+	code, verifier := login(t, idp, provider, "nonce-1")
+
+	_, err := provider.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err == nil {
+		t.Fatal("Exchange accepted an id_token with the wrong nonce")
+	}
+}
+
+func TestOIDCExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true})
+
+	provider := newTestOIDCProvider(t, idp)
+	code, _ := login(t, idp, provider, "nonce-1")
+
+	_, err := provider.Exchange(context.Background(), code, oauth2.GenerateVerifier(), "nonce-1")
+	if err == nil {
+		t.Fatal("Exchange succeeded with the wrong PKCE verifier")
+	}
+}
+
+func TestOIDCExchangeCodeIsSingleUse(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true})
+
+	provider := newTestOIDCProvider(t, idp)
+	code, verifier := login(t, idp, provider, "nonce-1")
+
+	_, err := provider.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	_, err = provider.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err == nil {
+		t.Fatal("Exchange accepted a code twice")
+	}
+}
+
+func TestOIDCExchangeReportsUnverifiedEmail(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: false})
+
+	provider := newTestOIDCProvider(t, idp)
+	code, verifier := login(t, idp, provider, "nonce-1")
+
+	identity, err := provider.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	if identity.EmailVerified {
+		t.Error("identity has a verified email, the IdP did not verify it")
+	}
+}
+
+func TestOIDCProviderRejectsOtherClient(t *testing.T) {
+	idp := oauthtest.NewIdP()
+	defer idp.Close()
+
+	idp.SetLogin(oauthtest.Login{Subject: "user-1", Email: "ada@example.com", EmailVerified: true})
+
+	// The id_token is issued for another client id than the one we verify
+	provider := newTestOIDCProvider(t, idp)
+	other, err := NewOIDCProvider(context.Background(), "test", ProviderConfig{
+		ClientID:    "someone-else",
+		RedirectURL: testRedirectURL,
+		IssuerURL:   idp.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+
+	code, verifier := login(t, idp, other, "nonce-1")
+
+	_, err = provider.Exchange(context.Background(), code, verifier, "nonce-1")
+	if err == nil {
+		t.Fatal("Exchange accepted an id_token for another client")
+	}
+}
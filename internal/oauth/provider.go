@@ -0,0 +1,97 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/elidotexe/backend_byteurl/internal/config"
+)
+
+// ErrEmailNotVerified is returned when the provider cannot vouch for the
+// user's email address
+var ErrEmailNotVerified = errors.New("email address is not verified by the provider")
+
+// Identity is what a provider tells us about the user after a successful login
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider is an external identity provider that supports the authorization
+// code flow with PKCE
+type Provider interface {
+	Name() string
+	// AuthCodeURL returns the URL the user is sent to in order to log in
+	AuthCodeURL(state, nonce, verifier string) string
+	// Exchange trades the authorization code for the user's identity
+	Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error)
+}
+
+// ProviderConfig holds the client registration for a provider
+type ProviderConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// IssuerURL is used for OpenID Connect discovery
+	IssuerURL string
+
+	// AuthURL, TokenURL and APIURL override the default endpoints of
+	// providers that do not support discovery
+	AuthURL  string
+	TokenURL string
+	APIURL   string
+}
+
+// NewProviders returns every provider that has a client id configured, keyed
+// by name. Providers that fail discovery are logged and skipped so that one
+// unavailable identity provider does not keep the API from starting.
+func NewProviders(ctx context.Context, app *config.AppConfig) map[string]Provider {
+	providers := make(map[string]Provider)
+
+	redirectURL := func(name string) string {
+		return app.OAUTH_REDIRECT_URL + "/api/oauth/" + name + "/callback"
+	}
+
+	if app.GITHUB_CLIENT_ID != "" {
+		providers["github"] = NewGitHubProvider(ProviderConfig{
+			ClientID:     app.GITHUB_CLIENT_ID,
+			ClientSecret: app.GITHUB_CLIENT_SECRET,
+			RedirectURL:  redirectURL("github"),
+		})
+	}
+
+	if app.GOOGLE_CLIENT_ID != "" {
+		provider, err := NewGoogleProvider(ctx, ProviderConfig{
+			ClientID:     app.GOOGLE_CLIENT_ID,
+			ClientSecret: app.GOOGLE_CLIENT_SECRET,
+			RedirectURL:  redirectURL("google"),
+		})
+		if err != nil {
+			log.Println("Cannot set up Google login:", err)
+		} else {
+			providers["google"] = provider
+		}
+	}
+
+	if app.OIDC_CLIENT_ID != "" && app.OIDC_NAME != "" {
+		provider, err := NewOIDCProvider(ctx, app.OIDC_NAME, ProviderConfig{
+			ClientID:     app.OIDC_CLIENT_ID,
+			ClientSecret: app.OIDC_CLIENT_SECRET,
+			RedirectURL:  redirectURL(app.OIDC_NAME),
+			IssuerURL:    app.OIDC_ISSUER_URL,
+		})
+		if err != nil {
+			log.Printf("Cannot set up %s login: %v\n", app.OIDC_NAME, err)
+		} else {
+			providers[app.OIDC_NAME] = provider
+		}
+	}
+
+	return providers
+}
@@ -0,0 +1,125 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const hashPrefixLength = 5
+
+// BreachedSet answers whether a password appears in a local copy of a breach
+// corpus. Lookups work like the k-anonymity range API of Have I Been Pwned:
+// the password is hashed with SHA-1 and only the suffixes of hashes that share
+// its five character prefix are looked at.
+//
+// The dataset is either a single file with one "HASH:COUNT" line per hash,
+// which is loaded into memory, or a directory with one "PREFIX.txt" file per
+// prefix holding "SUFFIX:COUNT" lines, which are read on demand. The second
+// layout is what the official downloader produces and suits the full corpus.
+type BreachedSet struct {
+	dir    string
+	ranges map[string]map[string]int
+}
+
+// LoadBreached opens the dataset at path
+func LoadBreached(path string) (*BreachedSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &BreachedSet{dir: path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := &BreachedSet{ranges: make(map[string]map[string]int)}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hash, count, ok := parseHashLine(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		if len(hash) != sha1.Size*2 {
+			return nil, errors.New("breached password file must contain full SHA-1 hashes")
+		}
+
+		prefix, suffix := hash[:hashPrefixLength], hash[hashPrefixLength:]
+		if set.ranges[prefix] == nil {
+			set.ranges[prefix] = make(map[string]int)
+		}
+		set.ranges[prefix][suffix] = count
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// Count returns how often the password was seen in breaches, 0 if never
+func (b *BreachedSet) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:hashPrefixLength], hash[hashPrefixLength:]
+
+	if b.dir == "" {
+		return b.ranges[prefix][suffix], nil
+	}
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineSuffix, count, ok := parseHashLine(scanner.Text())
+		if ok && lineSuffix == suffix {
+			return count, nil
+		}
+	}
+
+	return 0, scanner.Err()
+}
+
+// parseHashLine reads a "HASH:COUNT" line. The count is optional and
+// defaults to 1.
+func parseHashLine(line string) (string, int, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", 0, false
+	}
+
+	hash, countText, found := strings.Cut(line, ":")
+	hash = strings.ToUpper(strings.TrimSpace(hash))
+
+	count := 1
+	if found {
+		n, err := strconv.Atoi(strings.TrimSpace(countText))
+		if err != nil {
+			return "", 0, false
+		}
+		count = n
+	}
+
+	return hash, count, true
+}
@@ -0,0 +1,42 @@
+package passwords
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+)
+
+//go:embed common.txt
+var commonList string
+
+var common = loadCommon(commonList)
+
+func loadCommon(list string) map[string]bool {
+	words := make(map[string]bool)
+
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words[strings.ToLower(word)] = true
+		}
+	}
+
+	return words
+}
+
+// IsCommon reports whether the password is on the list of common passwords.
+// Trailing digits and symbols are ignored too, so "Password123!" counts as
+// "password".
+func IsCommon(password string) bool {
+	lower := strings.ToLower(password)
+	if common[lower] {
+		return true
+	}
+
+	base := strings.TrimRightFunc(lower, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z')
+	})
+
+	return base != "" && common[base]
+}
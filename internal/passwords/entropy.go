@@ -0,0 +1,72 @@
+package passwords
+
+import (
+	"math"
+	"unicode"
+)
+
+// Entropy estimates the strength of a password in bits. It starts from the
+// size of the character classes in use and discounts characters that repeat
+// or continue a sequence, such as "aaaa" or "1234". It is a rough estimate,
+// dictionary words are handled by the common password check.
+func Entropy(password string) float64 {
+	var lower, upper, digit, symbol, other bool
+	var length float64
+
+	var prev rune
+	var prevDelta rune
+	for i, r := range []rune(password) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+
+		delta := r - prev
+		switch {
+		case i == 0:
+			length++
+		case delta == 0:
+			// Repeated characters add very little
+			length += 0.25
+		case (delta == 1 || delta == -1) && delta == prevDelta:
+			// So does the continuation of a run such as "abc" or "321"
+			length += 0.25
+		default:
+			length++
+		}
+
+		prev = r
+		prevDelta = delta
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	return length * math.Log2(float64(pool))
+}
@@ -0,0 +1,126 @@
+package passwords
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bcrypt ignores everything after 72 bytes, so longer passwords are refused
+// instead of being silently truncated
+const maxPasswordBytes = 72
+
+// Codes of the rules a password can break
+const (
+	CodeTooShort     = "too_short"
+	CodeTooLong      = "too_long"
+	CodeTooWeak      = "too_weak"
+	CodeCommon       = "common"
+	CodePersonalInfo = "personal_info"
+	CodeBreached     = "breached"
+)
+
+// Violation is a rule that a password breaks
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Policy decides which passwords are good enough
+type Policy struct {
+	MinLength int
+	// MinEntropy is the minimum estimated strength in bits, see Entropy
+	MinEntropy float64
+	// AllowCommon turns off the check against the list of common passwords
+	AllowCommon bool
+	// Breached is checked when it is set. Passwords that were seen in at least
+	// BreachThreshold breaches are refused.
+	Breached        *BreachedSet
+	BreachThreshold int
+}
+
+// Validate returns every rule that the password breaks. userInputs are values
+// the password must not be based on, such as the user's name and email.
+func (p *Policy) Validate(password string, userInputs ...string) ([]Violation, error) {
+	var violations []Violation
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, Violation{
+			Code:    CodeTooShort,
+			Message: fmt.Sprintf("password must be at least %d characters", p.MinLength),
+		})
+	}
+
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, Violation{
+			Code:    CodeTooLong,
+			Message: fmt.Sprintf("password must be at most %d bytes", maxPasswordBytes),
+		})
+	}
+
+	if !p.AllowCommon && IsCommon(password) {
+		violations = append(violations, Violation{
+			Code:    CodeCommon,
+			Message: "password is too common",
+		})
+	} else if Entropy(password) < p.MinEntropy {
+		violations = append(violations, Violation{
+			Code:    CodeTooWeak,
+			Message: "password is too easy to guess, use a longer mix of words, numbers and symbols",
+		})
+	}
+
+	if containsPersonalInfo(password, userInputs) {
+		violations = append(violations, Violation{
+			Code:    CodePersonalInfo,
+			Message: "password must not contain your name or email",
+		})
+	}
+
+	if p.Breached != nil {
+		count, err := p.Breached.Count(password)
+		if err != nil {
+			return nil, err
+		}
+
+		threshold := p.BreachThreshold
+		if threshold <= 0 {
+			threshold = 1
+		}
+
+		if count >= threshold {
+			violations = append(violations, Violation{
+				Code:    CodeBreached,
+				Message: "password has appeared in a data breach, choose a different one",
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+// containsPersonalInfo reports whether the password contains a word of the
+// user's name or email. Only the local part of an email is used, and words
+// shorter than three characters are ignored.
+func containsPersonalInfo(password string, userInputs []string) bool {
+	lower := strings.ToLower(password)
+
+	for _, input := range userInputs {
+		if at := strings.LastIndex(input, "@"); at >= 0 {
+			input = input[:at]
+		}
+
+		words := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+		for _, word := range words {
+			if utf8.RuneCountInString(word) >= 3 && strings.Contains(lower, word) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,195 @@
+package qrcode
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+const (
+	MinSize   = 64
+	MaxSize   = 2048
+	MaxMargin = 16
+
+	// DefaultMargin is the quiet zone the QR specification asks for
+	DefaultMargin = 4
+	DefaultSize   = 256
+)
+
+var (
+	ErrSize   = fmt.Errorf("size must be between %d and %d pixels", MinSize, MaxSize)
+	ErrMargin = fmt.Errorf("margin must be between 0 and %d modules", MaxMargin)
+	ErrLevel  = errors.New("error correction level must be one of L, M, Q or H")
+	ErrColor  = errors.New("colour must be a hex value such as 000000 or #1a2b3c")
+)
+
+// Options describe how a code is rendered
+type Options struct {
+	// Size is the width and height of the image in pixels
+	Size int
+	// Margin is the width of the quiet zone around the code in modules
+	Margin     int
+	Level      qr.Level
+	Foreground color.RGBA
+	Background color.RGBA
+}
+
+// DefaultOptions returns black on white at medium error correction
+func DefaultOptions() Options {
+	return Options{
+		Size:       DefaultSize,
+		Margin:     DefaultMargin,
+		Level:      qr.M,
+		Foreground: color.RGBA{0, 0, 0, 0xff},
+		Background: color.RGBA{0xff, 0xff, 0xff, 0xff},
+	}
+}
+
+// Validate checks that the options can be rendered
+func (o Options) Validate() error {
+	if o.Size < MinSize || o.Size > MaxSize {
+		return ErrSize
+	}
+
+	if o.Margin < 0 || o.Margin > MaxMargin {
+		return ErrMargin
+	}
+
+	if o.Level < qr.L || o.Level > qr.H {
+		return ErrLevel
+	}
+
+	return nil
+}
+
+// ParseLevel reads an error correction level given as L, M, Q or H
+func ParseLevel(s string) (qr.Level, error) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return qr.L, nil
+	case "M":
+		return qr.M, nil
+	case "Q":
+		return qr.Q, nil
+	case "H":
+		return qr.H, nil
+	}
+
+	return 0, ErrLevel
+}
+
+// ParseColor reads a colour given as RRGGBB, with or without a leading "#"
+func ParseColor(s string) (color.RGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return color.RGBA{}, ErrColor
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, ErrColor
+	}
+
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
+
+// Code is an encoded QR code together with the options to render it
+type Code struct {
+	code *qr.Code
+	opts Options
+}
+
+// Encode encodes text with the given options
+func Encode(text string, opts Options) (*Code, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := qr.Encode(text, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Code{code: code, opts: opts}, nil
+}
+
+// modules returns the number of modules on a side, quiet zone included
+func (c *Code) modules() int {
+	return c.code.Size + 2*c.opts.Margin
+}
+
+// dark reports whether the module at x, y, counted from the edge of the quiet
+// zone, is dark
+func (c *Code) dark(x, y int) bool {
+	return c.code.Black(x-c.opts.Margin, y-c.opts.Margin)
+}
+
+// WritePNG renders the code as a PNG image. Modules are drawn at a whole
+// number of pixels so that they stay sharp, and the rest of the requested
+// size is filled with the background.
+func (c *Code) WritePNG(w io.Writer) error {
+	n := c.modules()
+
+	scale := c.opts.Size / n
+	if scale < 1 {
+		scale = 1
+	}
+
+	side := c.opts.Size
+	if scale*n > side {
+		side = scale * n
+	}
+	offset := (side - scale*n) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{c.opts.Background, c.opts.Foreground})
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if !c.dark(x, y) {
+				continue
+			}
+
+			for py := 0; py < scale; py++ {
+				row := (offset+y*scale+py)*img.Stride + offset + x*scale
+				for px := 0; px < scale; px++ {
+					img.Pix[row+px] = 1
+				}
+			}
+		}
+	}
+
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	return encoder.Encode(w, img)
+}
+
+// WriteSVG renders the code as an SVG image with one module per user unit
+func (c *Code) WriteSVG(w io.Writer) error {
+	n := c.modules()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, c.opts.Size, c.opts.Size, n, n)
+	fmt.Fprintf(bw, `<rect width="%d" height="%d" fill="%s"/>`, n, n, hex(c.opts.Background))
+	fmt.Fprintf(bw, `<path fill="%s" d="`, hex(c.opts.Foreground))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if c.dark(x, y) {
+				fmt.Fprintf(bw, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	bw.WriteString(`"/></svg>`)
+
+	return bw.Flush()
+}
+
+func hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
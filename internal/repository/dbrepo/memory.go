@@ -0,0 +1,150 @@
+package dbrepo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+)
+
+// memoryRevocationRepo keeps token revocations in process memory. It is meant
+// for tests and single instance deployments, as the state is lost on restart.
+type memoryRevocationRepo struct {
+	mu     sync.RWMutex
+	tokens map[string]time.Time
+	users  map[int]time.Time
+}
+
+func NewMemoryRevocationRepo() *memoryRevocationRepo {
+	return &memoryRevocationRepo{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int]time.Time),
+	}
+}
+
+func (m *memoryRevocationRepo) RevokeToken(jti string, userID int, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range m.tokens {
+		if exp.Before(now) {
+			delete(m.tokens, id)
+		}
+	}
+
+	m.tokens[jti] = expiresAt
+
+	return nil
+}
+
+func (m *memoryRevocationRepo) RevokeUserTokens(userID int, revokedBefore time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Tokens carry their issue time in whole seconds
+	m.users[userID] = revokedBefore.Truncate(time.Second)
+
+	return nil
+}
+
+func (m *memoryRevocationRepo) IsTokenRevoked(jti string, userID int, issuedAt time.Time) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.tokens[jti]; ok && jti != "" {
+		return true, nil
+	}
+
+	revokedBefore, ok := m.users[userID]
+	if !ok {
+		return false, nil
+	}
+
+	return issuedAt.Before(revokedBefore), nil
+}
+
+// memoryLoginAttemptRepo keeps failed login counters in process memory
+type memoryLoginAttemptRepo struct {
+	mu        sync.Mutex
+	attempts  map[string]models.LoginAttempt
+	lastSweep time.Time
+}
+
+func NewMemoryLoginAttemptRepo() *memoryLoginAttemptRepo {
+	return &memoryLoginAttemptRepo{
+		attempts: make(map[string]models.LoginAttempt),
+	}
+}
+
+func (m *memoryLoginAttemptRepo) GetLoginAttempt(key string) (*models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt, ok := m.attempts[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &attempt, nil
+}
+
+func (m *memoryLoginAttemptRepo) RecordLoginFailure(key string, at time.Time, windowStart time.Time) (*models.LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Keys are whatever clients send, so drop the ones that no longer count
+	// every now and then to keep the map from growing forever
+	if at.Sub(m.lastSweep) > at.Sub(windowStart) {
+		for k, attempt := range m.attempts {
+			locked := attempt.LockedUntil != nil && attempt.LockedUntil.After(at)
+			if attempt.LastFailedAt.Before(windowStart) && !locked {
+				delete(m.attempts, k)
+			}
+		}
+		m.lastSweep = at
+	}
+
+	attempt, ok := m.attempts[key]
+	if !ok {
+		attempt = models.LoginAttempt{Key: key}
+	}
+
+	lockExpired := attempt.LockedUntil != nil && attempt.LockedUntil.Before(at)
+	if attempt.LastFailedAt.Before(windowStart) || lockExpired {
+		attempt.Failures = 0
+	}
+	if lockExpired {
+		attempt.LockedUntil = nil
+	}
+
+	attempt.Failures++
+	attempt.LastFailedAt = at
+	m.attempts[key] = attempt
+
+	return &attempt, nil
+}
+
+func (m *memoryLoginAttemptRepo) LockLogin(key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempt, ok := m.attempts[key]
+	if !ok {
+		attempt = models.LoginAttempt{Key: key, LastFailedAt: time.Now()}
+	}
+
+	attempt.LockedUntil = &until
+	m.attempts[key] = attempt
+
+	return nil
+}
+
+func (m *memoryLoginAttemptRepo) ResetLoginAttempts(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+
+	return nil
+}
@@ -1,11 +1,16 @@
 package dbrepo
 
 import (
+	"database/sql"
 	"errors"
-	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/elidotexe/backend_byteurl/internal/models"
+	"github.com/elidotexe/backend_byteurl/internal/repository"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func (m *postgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
@@ -25,7 +30,7 @@ func (m *postgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 func (m *postgresDBRepo) GetUserByID(userID int) (*models.User, error) {
 	var user models.User
 
-	if err := m.DB.Select("id, name, email").First(&user, userID).Error; err != nil {
+	if err := m.DB.Select("id, name, email, email_verified_at, totp_secret, totp_enabled_at, totp_last_step, role, suspended_at, created_at").First(&user, userID).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, err
 		}
@@ -36,10 +41,12 @@ func (m *postgresDBRepo) GetUserByID(userID int) (*models.User, error) {
 	return &user, nil
 }
 
+// UserExists also counts accounts that are waiting to be purged, so that
+// their email cannot be taken while they can still be restored
 func (m *postgresDBRepo) UserExists(email string) (bool, error) {
 	var existingUser models.User
 
-	if err := m.DB.Where("email = ?", email).First(&existingUser).Error; err != nil {
+	if err := m.DB.Unscoped().Where("email = ?", email).First(&existingUser).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return false, nil
 		}
@@ -65,6 +72,262 @@ func (m *postgresDBRepo) UpdateUserNameByID(userID int, user *models.User) error
 	return nil
 }
 
+func (m *postgresDBRepo) UpdateUserPasswordByID(userID int, hashedPassword string) error {
+	if err := m.DB.Model(&models.User{}).Where("id = ?", userID).Update("password", hashedPassword).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateUserEmailByID changes the email address. The new address has been
+// confirmed by the caller, so it is marked as verified.
+func (m *postgresDBRepo) UpdateUserEmailByID(userID int, email string) error {
+	if err := m.DB.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"email":             email,
+		"email_verified_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) MarkUserEmailVerified(userID int) error {
+	if err := m.DB.Model(&models.User{}).
+		Where("id = ? AND email_verified_at IS NULL", userID).
+		Update("email_verified_at", time.Now()).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SearchUsers returns a page of users whose name or email contains query,
+// together with the number of matching users
+func (m *postgresDBRepo) SearchUsers(query string, offset, limit int) ([]models.User, int64, error) {
+	var users []models.User
+	var total int64
+
+	tx := m.DB.Model(&models.User{})
+	if query != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+		tx = tx.Where("name ILIKE ? OR email ILIKE ?", pattern, pattern)
+	}
+
+	if err := tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	if err := tx.Select("id, name, email, email_verified_at, totp_enabled_at, role, suspended_at, created_at").
+		Order("id").Offset(offset).Limit(limit).Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+func (m *postgresDBRepo) UpdateUserRole(userID int, role string) error {
+	result := m.DB.Model(&models.User{}).Where("id = ?", userID).Update("role", role)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+
+	return nil
+}
+
+// SetUserSuspended suspends the user, or reactivates them when suspendedAt is nil
+func (m *postgresDBRepo) SetUserSuspended(userID int, suspendedAt *time.Time) error {
+	result := m.DB.Model(&models.User{}).Where("id = ?", userID).Update("suspended_at", suspendedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) SoftDeleteUser(userID int) error {
+	result := m.DB.Delete(&models.User{}, userID)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) RestoreUser(userID int) error {
+	result := m.DB.Unscoped().Model(&models.User{}).
+		Where("id = ? AND deleted_at IS NOT NULL", userID).
+		Update("deleted_at", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+
+	return nil
+}
+
+// PurgeDeletedUsers removes accounts that were deleted before the given time
+// together with everything that belongs to them. It returns the number of
+// purged accounts.
+func (m *postgresDBRepo) PurgeDeletedUsers(deletedBefore time.Time) (int64, error) {
+	var purged int64
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		userIDs := tx.Unscoped().Model(&models.User{}).Select("id").Where("deleted_at IS NOT NULL AND deleted_at < ?", deletedBefore)
+		linkIDs := tx.Model(&models.Link{}).Select("id").Where("user_id IN (?)", userIDs)
+
+		if err := tx.Where("link_id IN (?)", linkIDs).Delete(&models.RedirectHistory{}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{
+			&models.Link{},
+			&models.RefreshToken{},
+			&models.Session{},
+			&models.RevokedToken{},
+			&models.UserTokenRevocation{},
+			&models.UserToken{},
+			&models.RecoveryCode{},
+			&models.Identity{},
+			&models.APIToken{},
+			&models.AuditEvent{},
+			&models.BulkJob{},
+		} {
+			if err := tx.Where("user_id IN (?)", userIDs).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		result := tx.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", deletedBefore).Delete(&models.User{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		purged = result.RowsAffected
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+func (m *postgresDBRepo) SetUserTOTPSecret(userID int, secret string) error {
+	if err := m.DB.Model(&models.User{}).
+		Where("id = ? AND totp_enabled_at IS NULL", userID).
+		Update("totp_secret", secret).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnableUserTOTP turns on two-factor authentication and replaces the user's
+// recovery codes in a single transaction
+func (m *postgresDBRepo) EnableUserTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_enabled_at": time.Now(),
+			"totp_last_step":  step,
+		}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		codes := make([]models.RecoveryCode, 0, len(recoveryCodeHashes))
+		for _, hash := range recoveryCodeHashes {
+			codes = append(codes, models.RecoveryCode{
+				UserID:    userID,
+				CodeHash:  hash,
+				CreatedAt: time.Now(),
+			})
+		}
+
+		return tx.Create(&codes).Error
+	})
+}
+
+func (m *postgresDBRepo) DisableUserTOTP(userID int) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// UseTOTPStep records the time step of an accepted TOTP code. It returns false
+// when a code from the same or a later step was already used.
+func (m *postgresDBRepo) UseTOTPStep(userID int, step int64) (bool, error) {
+	result := m.DB.Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+func (m *postgresDBRepo) ConsumeRecoveryCode(userID int, codeHash string) (bool, error) {
+	result := m.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+func (m *postgresDBRepo) GetIdentity(provider, subject string) (*models.Identity, error) {
+	var identity models.Identity
+
+	if err := m.DB.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+func (m *postgresDBRepo) InsertIdentity(identity *models.Identity) error {
+	if err := m.DB.Create(identity).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (m *postgresDBRepo) GetAllLinks(userID int) ([]models.Link, error) {
 	var links []models.Link
 
@@ -76,43 +339,178 @@ func (m *postgresDBRepo) GetAllLinks(userID int) ([]models.Link, error) {
 }
 
 func (m *postgresDBRepo) InsertLink(link *models.Link) (*models.Link, error) {
-	var maxLinkID int
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		number, err := reserveLinkNumbers(tx, link.UserID, 1)
+		if err != nil {
+			return err
+		}
+
+		link.ID = 0
+		link.Number = number
+
+		return tx.Create(link).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, repository.ErrShortURLTaken
+		}
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// reserveLinkNumbers takes the next n link numbers of a user and returns the
+// first. The row lock on the user keeps concurrent inserts from getting the
+// same numbers; numbers of failed inserts are not reused.
+func reserveLinkNumbers(tx *gorm.DB, userID, n int) (int, error) {
+	var last int
+
+	err := tx.Raw("UPDATE users SET last_link_number = last_link_number + ? WHERE id = ? RETURNING last_link_number", n, userID).Row().Scan(&last)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, errors.New("user not found")
+		}
+
+		return 0, err
+	}
+
+	return last - n + 1, nil
+}
+
+// InsertLinks inserts links of one user in a single transaction. A link whose
+// short url is already taken gets repository.ErrShortURLTaken at its index in
+// the returned slice and the rest of the batch is still inserted.
+func (m *postgresDBRepo) InsertLinks(userID int, links []*models.Link) ([]error, error) {
+	rowErrors := make([]error, len(links))
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		first, err := reserveLinkNumbers(tx, userID, len(links))
+		if err != nil {
+			return err
+		}
+
+		for i, link := range links {
+			link.ID = 0
+			link.UserID = userID
+			link.Number = first + i
+		}
+
+		err = tx.Transaction(func(tx *gorm.DB) error {
+			return tx.CreateInBatches(links, len(links)).Error
+		})
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			return err
+		}
+
+		// Some short url is taken, so insert the links one by one to find out
+		// which. Every insert gets its own savepoint.
+		for i, link := range links {
+			link.ID = 0
+
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				return tx.Create(link).Error
+			})
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				rowErrors[i] = repository.ErrShortURLTaken
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rowErrors, nil
+}
+
+// GetLinkByNumber looks up a link by its number within the links of a user
+func (m *postgresDBRepo) GetLinkByNumber(userID, number int) (*models.Link, error) {
+	var link models.Link
+
+	if err := m.DB.Where("user_id = ? AND number = ?", userID, number).First(&link).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
 
-	if err := m.DB.Model(&models.Link{}).Where("user_id = ?", link.UserID).Select("COALESCE(MAX(id), 0)").Row().Scan(&maxLinkID); err != nil {
 		return nil, err
 	}
 
-	link.ID = maxLinkID + 1
+	return &link, nil
+}
 
-	if err := m.DB.Create(link).Error; err != nil {
+// GetLinkByShortenURL looks up a link by its short url. Generated short urls
+// are case sensitive, aliases are stored in lower case, so an alias is found
+// whatever case it is typed in.
+func (m *postgresDBRepo) GetLinkByShortenURL(shortenURL string) (*models.Link, error) {
+	link, err := m.findLinkByShortenURL(shortenURL)
+	if errors.Is(err, gorm.ErrRecordNotFound) && strings.ToLower(shortenURL) != shortenURL {
+		link, err = m.findLinkByShortenURL(strings.ToLower(shortenURL))
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("link not found")
+		}
 		return nil, err
 	}
 
 	return link, nil
 }
 
-func (m *postgresDBRepo) GetLink(userID, linkID int) (*models.Link, error) {
+func (m *postgresDBRepo) findLinkByShortenURL(shortenURL string) (*models.Link, error) {
 	var link models.Link
 
-	result := m.DB.Where("user_id = ? AND id = ?", userID, linkID).First(&link)
+	// Links of deleted and suspended accounts stop working right away
+	result := m.DB.
+		Where("shorten_url = ?", shortenURL).
+		Where("EXISTS (SELECT 1 FROM users WHERE users.id = links.user_id AND users.deleted_at IS NULL AND users.suspended_at IS NULL)").
+		First(&link)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 
-	if result.RowsAffected == 0 {
-		return nil, errors.New("link not found")
+	return &link, nil
+}
+
+// TakenShortenURLs reports which of the candidates are already used by a link
+func (m *postgresDBRepo) TakenShortenURLs(candidates []string) (map[string]bool, error) {
+	var taken []string
+
+	if err := m.DB.Model(&models.Link{}).Where("shorten_url IN ?", candidates).Pluck("shorten_url", &taken).Error; err != nil {
+		return nil, err
 	}
 
-	return &link, nil
+	result := make(map[string]bool, len(taken))
+	for _, shortenURL := range taken {
+		result[shortenURL] = true
+	}
+
+	return result, nil
 }
 
-func (m *postgresDBRepo) GetLinkByShortenURL(shortenURL string) (*models.Link, error) {
+// NextShortCodeCounter returns the next value of the short code sequence
+func (m *postgresDBRepo) NextShortCodeCounter() (uint64, error) {
+	var value uint64
+
+	if err := m.DB.Raw("SELECT nextval('short_code_counter')").Row().Scan(&value); err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+func (m *postgresDBRepo) GetLinkByPublicID(publicID string) (*models.Link, error) {
 	var link models.Link
 
-	result := m.DB.Where("shorten_url = ?", shortenURL).First(&link)
+	result := m.DB.Where("public_id = ?", publicID).First(&link)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("link not found")
+			return nil, nil
 		}
 		return nil, result.Error
 	}
@@ -120,30 +518,40 @@ func (m *postgresDBRepo) GetLinkByShortenURL(shortenURL string) (*models.Link, e
 	return &link, nil
 }
 
-func (m *postgresDBRepo) UpdateLink(link *models.Link) (*models.Link, error) {
-	result := m.DB.Model(&models.Link{}).Where("user_id = ? AND id = ?", link.UserID, link.ID).Updates(models.Link{
-		Title:       link.Title,
-		OriginalURL: link.OriginalURL,
-		UpdatedAt:   link.UpdatedAt,
-	})
+// SetLinkDisabled disables the link, or enables it again when disabledAt is nil
+func (m *postgresDBRepo) SetLinkDisabled(linkID int, disabledAt *time.Time) error {
+	result := m.DB.Model(&models.Link{}).Where("id = ?", linkID).UpdateColumn("disabled_at", disabledAt)
 	if result.Error != nil {
-		return nil, result.Error
+		return result.Error
 	}
 
 	if result.RowsAffected == 0 {
-		return nil, errors.New("link not found")
+		return errors.New("link not found")
 	}
 
-	return link, nil
+	return nil
 }
 
-func (m *postgresDBRepo) UpdateRedirectDetails(link *models.Link) (*models.Link, error) {
-	result := m.DB.Model(&models.Link{}).
-		Where("user_id = ? AND id = ?", link.UserID, link.ID).
-		Updates(map[string]interface{}{
-			"clicks": link.Clicks,
+func (m *postgresDBRepo) UpdateLink(link *models.Link) (*models.Link, error) {
+	// The limits are listed explicitly so that they can also be removed
+	result := m.DB.Model(&models.Link{}).Where("user_id = ? AND id = ?", link.UserID, link.ID).
+		Select("title", "original_url", "shorten_url", "expires_at", "max_clicks", "fallback_url", "redirect_type", "status", "password_hash", "updated_at").
+		Updates(models.Link{
+			Title:        link.Title,
+			OriginalURL:  link.OriginalURL,
+			ShortenURL:   link.ShortenURL,
+			ExpiresAt:    link.ExpiresAt,
+			MaxClicks:    link.MaxClicks,
+			FallbackURL:  link.FallbackURL,
+			RedirectType: link.RedirectType,
+			Status:       link.Status,
+			PasswordHash: link.PasswordHash,
+			UpdatedAt:    link.UpdatedAt,
 		})
 	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+			return nil, repository.ErrShortURLTaken
+		}
 		return nil, result.Error
 	}
 
@@ -151,24 +559,80 @@ func (m *postgresDBRepo) UpdateRedirectDetails(link *models.Link) (*models.Link,
 		return nil, errors.New("link not found")
 	}
 
-	//TODO: Figure out why updatedAt gets updated to the current time
-	fmt.Println("link", link.UpdatedAt)
-
 	return link, nil
 }
 
-func (m *postgresDBRepo) InsertRedirectHistory(redirect *models.RedirectHistory) (*models.RedirectHistory, error) {
-	var maxRedirectID int
+// IncrementLinkClicks adds batched clicks to links. The clicks are added up in
+// the database, so concurrent writers cannot overwrite each other, and
+// updated_at is left alone because a click is not an edit.
+func (m *postgresDBRepo) IncrementLinkClicks(counts map[int]int) error {
+	// Links are updated in the same order everywhere so that two flushes
+	// cannot deadlock on each other's rows
+	linkIDs := make([]int, 0, len(counts))
+	for linkID := range counts {
+		linkIDs = append(linkIDs, linkID)
+	}
+	sort.Ints(linkIDs)
 
-	if err := m.DB.Model(&models.RedirectHistory{}).
-		Where("link_id = ?", redirect.LinkID).
-		Select("COALESCE(MAX(id), 0)").
-		Row().
-		Scan(&maxRedirectID); err != nil {
-		return nil, err
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		for _, linkID := range linkIDs {
+			err := tx.Model(&models.Link{}).Where("id = ?", linkID).
+				UpdateColumn("clicks", gorm.Expr("clicks + ?", counts[linkID])).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// CountLimitedLinkClick counts a click on a link with a click limit right
+// away, unless the limit has been reached. It reports whether the click counted.
+func (m *postgresDBRepo) CountLimitedLinkClick(linkID int) (bool, error) {
+	result := m.DB.Model(&models.Link{}).
+		Where("id = ? AND (max_clicks IS NULL OR clicks < max_clicks)", linkID).
+		UpdateColumn("clicks", gorm.Expr("clicks + 1"))
+	if result.Error != nil {
+		return false, result.Error
 	}
 
-	redirect.ID = maxRedirectID + 1
+	return result.RowsAffected > 0, nil
+}
+
+// MarkFinishedLinks stores the status of active links that have expired or
+// used up their clicks. It returns the number of links that changed.
+func (m *postgresDBRepo) MarkFinishedLinks(now time.Time) (int64, error) {
+	var marked int64
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Link{}).
+			Where("status = ? AND expires_at IS NOT NULL AND expires_at <= ?", models.LinkStatusActive, now).
+			UpdateColumn("status", models.LinkStatusExpired)
+		if result.Error != nil {
+			return result.Error
+		}
+		marked += result.RowsAffected
+
+		result = tx.Model(&models.Link{}).
+			Where("status = ? AND max_clicks IS NOT NULL AND clicks >= max_clicks", models.LinkStatusActive).
+			UpdateColumn("status", models.LinkStatusExhausted)
+		if result.Error != nil {
+			return result.Error
+		}
+		marked += result.RowsAffected
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return marked, nil
+}
+
+func (m *postgresDBRepo) InsertRedirectHistory(redirect *models.RedirectHistory) (*models.RedirectHistory, error) {
+	redirect.ID = 0
 
 	if err := m.DB.Create(redirect).Error; err != nil {
 		return nil, err
@@ -177,6 +641,23 @@ func (m *postgresDBRepo) InsertRedirectHistory(redirect *models.RedirectHistory)
 	return redirect, nil
 }
 
+// EachRedirectHistory passes the redirect history of every link of a user to
+// fn in batches, so that large histories never have to be held in memory
+func (m *postgresDBRepo) EachRedirectHistory(userID, batchSize int, fn func([]models.RedirectHistory) error) error {
+	var batch []models.RedirectHistory
+
+	result := m.DB.
+		Select("redirect_histories.*, links.public_id AS link_public_id").
+		Joins("JOIN links ON links.id = redirect_histories.link_id").
+		Where("links.user_id = ?", userID).
+		Order("redirect_histories.id").
+		FindInBatches(&batch, batchSize, func(tx *gorm.DB, _ int) error {
+			return fn(batch)
+		})
+
+	return result.Error
+}
+
 func (m *postgresDBRepo) DeleteLink(userID int, linkID int) error {
 	result := m.DB.Where("user_id = ? AND id = ?", userID, linkID).Delete(&models.Link{})
 	if result.Error != nil {
@@ -199,3 +680,448 @@ func (m *postgresDBRepo) GetLinksWithRedirectHistory(userID int) ([]*models.Link
 
 	return links, nil
 }
+
+func (m *postgresDBRepo) InsertRefreshToken(token *models.RefreshToken) error {
+	if err := m.DB.Create(token).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) GetRefreshTokenByHash(tokenHash string) (*models.RefreshToken, error) {
+	var token models.RefreshToken
+
+	if err := m.DB.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// RotateRefreshToken revokes the current token and stores the next one in a
+// single transaction. It returns false when the current token was already
+// revoked, which means it has been used before.
+func (m *postgresDBRepo) RotateRefreshToken(current *models.RefreshToken, next *models.RefreshToken) (bool, error) {
+	rotated := false
+
+	err := m.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", current.ID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return nil
+		}
+
+		if err := tx.Create(next).Error; err != nil {
+			return err
+		}
+
+		rotated = true
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return rotated, nil
+}
+
+// RevokeRefreshTokenFamily also ends the session the family belongs to
+func (m *postgresDBRepo) RevokeRefreshTokenFamily(familyID string) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Session{}).
+			Where("id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", time.Now()).Error
+	})
+}
+
+// RevokeUserRefreshTokens also ends every session of the user
+func (m *postgresDBRepo) RevokeUserRefreshTokens(userID int) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", time.Now()).Error
+	})
+}
+
+func (m *postgresDBRepo) InsertSession(session *models.Session) error {
+	if err := m.DB.Create(session).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetActiveSessions returns the sessions of a user that have not been revoked
+// and were used after seenAfter, most recently used first
+func (m *postgresDBRepo) GetActiveSessions(userID int, seenAfter time.Time) ([]models.Session, error) {
+	var sessions []models.Session
+
+	if err := m.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND last_seen_at > ?", userID, seenAfter).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession ends a single session of a user and revokes its refresh tokens
+func (m *postgresDBRepo) RevokeSession(userID int, sessionID string) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return errors.New("session not found")
+		}
+
+		return tx.Model(&models.RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", sessionID).
+			Update("revoked_at", time.Now()).Error
+	})
+}
+
+func (m *postgresDBRepo) GetSession(sessionID string) (*models.Session, error) {
+	var session models.Session
+
+	if err := m.DB.Where("id = ?", sessionID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (m *postgresDBRepo) TouchSession(sessionID string, at time.Time) error {
+	if err := m.DB.Model(&models.Session{}).Where("id = ?", sessionID).Update("last_seen_at", at).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) RevokeToken(jti string, userID int, expiresAt time.Time) error {
+	// Revocations are only useful until the token expires, so clean up old ones
+	if err := m.DB.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{}).Error; err != nil {
+		return err
+	}
+
+	token := models.RevokedToken{
+		JTI:       jti,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	if err := m.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&token).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) RevokeUserTokens(userID int, revokedBefore time.Time) error {
+	revocation := models.UserTokenRevocation{
+		UserID:        userID,
+		RevokedBefore: revokedBefore.Truncate(time.Second),
+	}
+
+	if err := m.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"revoked_before"}),
+	}).Create(&revocation).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) IsTokenRevoked(jti string, userID int, issuedAt time.Time) (bool, error) {
+	var count int64
+
+	if jti != "" {
+		if err := m.DB.Model(&models.RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+			return false, err
+		}
+
+		if count > 0 {
+			return true, nil
+		}
+	}
+
+	var revocation models.UserTokenRevocation
+
+	if err := m.DB.Where("user_id = ?", userID).First(&revocation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return issuedAt.Before(revocation.RevokedBefore), nil
+}
+
+func (m *postgresDBRepo) InsertUserToken(token *models.UserToken) error {
+	if err := m.DB.Create(token).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetUserToken returns a token that can still be used without using it up
+func (m *postgresDBRepo) GetUserToken(scope, tokenHash string) (*models.UserToken, error) {
+	var token models.UserToken
+
+	if err := m.DB.Where("scope = ? AND token_hash = ? AND used_at IS NULL AND expires_at > ?", scope, tokenHash, time.Now()).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// ConsumeUserToken marks a valid token as used and returns it. It returns nil
+// when the token does not exist, has expired or has already been used.
+func (m *postgresDBRepo) ConsumeUserToken(scope, tokenHash string) (*models.UserToken, error) {
+	var token models.UserToken
+
+	result := m.DB.Model(&token).
+		Clauses(clause.Returning{}).
+		Where("scope = ? AND token_hash = ? AND used_at IS NULL AND expires_at > ?", scope, tokenHash, time.Now()).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &token, nil
+}
+
+func (m *postgresDBRepo) InvalidateUserTokens(userID int, scope string) error {
+	if err := m.DB.Model(&models.UserToken{}).
+		Where("user_id = ? AND scope = ? AND used_at IS NULL", userID, scope).
+		Update("used_at", time.Now()).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) GetAllAPITokens(userID int) ([]models.APIToken, error) {
+	var tokens []models.APIToken
+
+	if err := m.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (m *postgresDBRepo) InsertAPIToken(token *models.APIToken) error {
+	if err := m.DB.Create(token).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) DeleteAPIToken(userID, tokenID int) error {
+	result := m.DB.Where("user_id = ? AND id = ?", userID, tokenID).Delete(&models.APIToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errors.New("token not found")
+	}
+
+	return nil
+}
+
+// GetAPITokenByHash returns the API token with the given hash. Tokens of
+// suspended or deleted users are not returned, they work again once the user
+// is reactivated or restores their account.
+func (m *postgresDBRepo) GetAPITokenByHash(tokenHash string) (*models.APIToken, error) {
+	var token models.APIToken
+
+	err := m.DB.Joins("JOIN users ON users.id = api_tokens.user_id").
+		Where("api_tokens.token_hash = ? AND users.suspended_at IS NULL AND users.deleted_at IS NULL", tokenHash).
+		First(&token).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (m *postgresDBRepo) TouchAPIToken(tokenID int) error {
+	if err := m.DB.Model(&models.APIToken{}).Where("id = ?", tokenID).Update("last_used_at", time.Now()).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) GetLoginAttempt(key string) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+
+	if err := m.DB.Where(`"key" = ?`, key).First(&attempt).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// RecordLoginFailure increments the failure counter of a key in one statement.
+// The counter starts over when the last failure is older than windowStart or
+// when a previous lockout has run out.
+func (m *postgresDBRepo) RecordLoginFailure(key string, at time.Time, windowStart time.Time) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+
+	err := m.DB.Raw(`
+		INSERT INTO login_attempts ("key", failures, last_failed_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT ("key") DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failed_at < ? OR login_attempts.locked_until < EXCLUDED.last_failed_at THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			locked_until = CASE
+				WHEN login_attempts.locked_until < EXCLUDED.last_failed_at THEN NULL
+				ELSE login_attempts.locked_until
+			END,
+			last_failed_at = EXCLUDED.last_failed_at
+		RETURNING *`, key, at, windowStart).Scan(&attempt).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+func (m *postgresDBRepo) LockLogin(key string, until time.Time) error {
+	if err := m.DB.Model(&models.LoginAttempt{}).Where(`"key" = ?`, key).Update("locked_until", until).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) ResetLoginAttempts(key string) error {
+	if err := m.DB.Where(`"key" = ?`, key).Delete(&models.LoginAttempt{}).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) InsertBulkJob(job *models.BulkJob) error {
+	if err := m.DB.Create(job).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *postgresDBRepo) GetBulkJob(userID int, jobID string) (*models.BulkJob, error) {
+	var job models.BulkJob
+
+	if err := m.DB.Where("user_id = ? AND id = ?", userID, jobID).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// UpdateBulkJob saves the progress of a bulk job
+func (m *postgresDBRepo) UpdateBulkJob(job *models.BulkJob) error {
+	result := m.DB.Model(&models.BulkJob{}).Where("id = ?", job.ID).
+		Select("status", "processed", "succeeded", "failed", "results", "error", "updated_at", "finished_at").
+		Updates(job)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errors.New("bulk job not found")
+	}
+
+	return nil
+}
+
+// FailStaleBulkJobs marks unfinished bulk jobs that have not saved any
+// progress since updatedBefore as failed. It returns the number of jobs.
+func (m *postgresDBRepo) FailStaleBulkJobs(updatedBefore time.Time, reason string) (int64, error) {
+	result := m.DB.Model(&models.BulkJob{}).
+		Where("status IN ? AND COALESCE(updated_at, created_at) < ?", []string{models.BulkJobPending, models.BulkJobRunning}, updatedBefore).
+		UpdateColumns(map[string]interface{}{
+			"status":      models.BulkJobFailed,
+			"error":       reason,
+			"updated_at":  time.Now(),
+			"finished_at": time.Now(),
+		})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	return result.RowsAffected, nil
+}
+
+func (m *postgresDBRepo) InsertAuditEvent(event *models.AuditEvent) error {
+	if err := m.DB.Create(event).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
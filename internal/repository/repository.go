@@ -1,6 +1,15 @@
 package repository
 
-import "github.com/elidotexe/backend_byteurl/internal/models"
+import (
+	"errors"
+	"time"
+
+	"github.com/elidotexe/backend_byteurl/internal/models"
+)
+
+// ErrShortURLTaken is returned when a link is saved with a short url that
+// another link already uses
+var ErrShortURLTaken = errors.New("short url is already taken")
 
 type DatabaseRepo interface {
 	GetUserByEmail(email string) (*models.User, error)
@@ -8,16 +17,90 @@ type DatabaseRepo interface {
 	UserExists(email string) (bool, error)
 	CreateUser(user *models.User) error
 	UpdateUserNameByID(userID int, user *models.User) error
+	UpdateUserPasswordByID(userID int, hashedPassword string) error
+	UpdateUserEmailByID(userID int, email string) error
+	MarkUserEmailVerified(userID int) error
+	SearchUsers(query string, offset, limit int) ([]models.User, int64, error)
+	UpdateUserRole(userID int, role string) error
+	SetUserSuspended(userID int, suspendedAt *time.Time) error
+	SoftDeleteUser(userID int) error
+	RestoreUser(userID int) error
+	PurgeDeletedUsers(deletedBefore time.Time) (int64, error)
+	SetUserTOTPSecret(userID int, secret string) error
+	EnableUserTOTP(userID int, step int64, recoveryCodeHashes []string) error
+	DisableUserTOTP(userID int) error
+	UseTOTPStep(userID int, step int64) (bool, error)
+	ConsumeRecoveryCode(userID int, codeHash string) (bool, error)
+
+	GetIdentity(provider, subject string) (*models.Identity, error)
+	InsertIdentity(identity *models.Identity) error
 
 	GetAllLinks(userID int) ([]models.Link, error)
 	InsertLink(link *models.Link) (*models.Link, error)
-	GetLink(userID, linkID int) (*models.Link, error)
+	InsertLinks(userID int, links []*models.Link) ([]error, error)
+	GetLinkByNumber(userID, number int) (*models.Link, error)
+	GetLinkByPublicID(publicID string) (*models.Link, error)
 	GetLinkByShortenURL(shortenURL string) (*models.Link, error)
+	TakenShortenURLs(candidates []string) (map[string]bool, error)
+	NextShortCodeCounter() (uint64, error)
+	SetLinkDisabled(linkID int, disabledAt *time.Time) error
 	UpdateLink(link *models.Link) (*models.Link, error)
-	UpdateRedirectDetails(link *models.Link) (*models.Link, error)
+	IncrementLinkClicks(counts map[int]int) error
+	CountLimitedLinkClick(linkID int) (bool, error)
+	MarkFinishedLinks(now time.Time) (int64, error)
 	DeleteLink(userID int, linkID int) error
 
 	InsertRedirectHistory(redirect *models.RedirectHistory) (*models.RedirectHistory, error)
+	EachRedirectHistory(userID, batchSize int, fn func([]models.RedirectHistory) error) error
 
 	GetLinksWithRedirectHistory(userID int) ([]*models.Link, error)
+
+	InsertRefreshToken(token *models.RefreshToken) error
+	GetRefreshTokenByHash(tokenHash string) (*models.RefreshToken, error)
+	RotateRefreshToken(current *models.RefreshToken, next *models.RefreshToken) (bool, error)
+	RevokeRefreshTokenFamily(familyID string) error
+	RevokeUserRefreshTokens(userID int) error
+
+	InsertSession(session *models.Session) error
+	GetActiveSessions(userID int, seenAfter time.Time) ([]models.Session, error)
+	RevokeSession(userID int, sessionID string) error
+
+	InsertUserToken(token *models.UserToken) error
+	GetUserToken(scope, tokenHash string) (*models.UserToken, error)
+	ConsumeUserToken(scope, tokenHash string) (*models.UserToken, error)
+	InvalidateUserTokens(userID int, scope string) error
+
+	GetAllAPITokens(userID int) ([]models.APIToken, error)
+	InsertAPIToken(token *models.APIToken) error
+	DeleteAPIToken(userID, tokenID int) error
+
+	InsertBulkJob(job *models.BulkJob) error
+	GetBulkJob(userID int, jobID string) (*models.BulkJob, error)
+	UpdateBulkJob(job *models.BulkJob) error
+	FailStaleBulkJobs(updatedBefore time.Time, reason string) (int64, error)
+
+	InsertAuditEvent(event *models.AuditEvent) error
+}
+
+type RevocationRepo interface {
+	RevokeToken(jti string, userID int, expiresAt time.Time) error
+	RevokeUserTokens(userID int, revokedBefore time.Time) error
+	IsTokenRevoked(jti string, userID int, issuedAt time.Time) (bool, error)
+}
+
+type APITokenRepo interface {
+	GetAPITokenByHash(tokenHash string) (*models.APIToken, error)
+	TouchAPIToken(tokenID int) error
+}
+
+type LoginAttemptRepo interface {
+	GetLoginAttempt(key string) (*models.LoginAttempt, error)
+	RecordLoginFailure(key string, at time.Time, windowStart time.Time) (*models.LoginAttempt, error)
+	LockLogin(key string, until time.Time) error
+	ResetLoginAttempts(key string) error
+}
+
+type SessionRepo interface {
+	GetSession(sessionID string) (*models.Session, error)
+	TouchSession(sessionID string, at time.Time) error
 }
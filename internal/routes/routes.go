@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"expvar"
 	"net/http"
+	"time"
 
 	"github.com/elidotexe/backend_byteurl/internal/auth"
 	"github.com/elidotexe/backend_byteurl/internal/config"
@@ -18,31 +20,133 @@ func SetupRoutes(app *config.AppConfig, authInstance *auth.Auth) http.Handler {
 	mux.Use(authMiddleware.EnableCORS)
 	mux.Use(middleware.Recoverer)
 
+	if app.TRUST_PROXY_HEADERS {
+		mux.Use(middleware.RealIP)
+	}
+
 	mux.Get("/", handlers.Repo.Home)
 
 	mux.Post("/login", handlers.Repo.Login)
+	mux.Post("/login/totp", handlers.Repo.LoginTOTP)
+	mux.With(middlewares.RateLimit(5, time.Minute*15)).Post("/login/magic", handlers.Repo.MagicLinkLogin)
+	mux.Post("/login/magic/callback", handlers.Repo.MagicLinkCallback)
 	mux.Post("/signup", handlers.Repo.Signup)
+	mux.Post("/refresh", handlers.Repo.RefreshToken)
+	mux.Post("/logout", handlers.Repo.Logout)
+	mux.With(authMiddleware.RequireAuth, authMiddleware.RequireSession).Post("/logout-all", handlers.Repo.LogoutAll)
+
+	mux.Get("/oauth/{provider}", handlers.Repo.OAuthLogin)
+	mux.Get("/oauth/{provider}/callback", handlers.Repo.OAuthCallback)
+
+	mux.With(middlewares.RateLimit(5, time.Minute*15)).Post("/password/forgot", handlers.Repo.ForgotPassword)
+	mux.Post("/password/reset", handlers.Repo.ResetPassword)
+
+	mux.Get("/unlock", handlers.Repo.UnlockAccount)
+
+	mux.Get("/verify-email", handlers.Repo.VerifyEmail)
+	mux.With(middlewares.RateLimit(5, time.Minute*15)).Post("/verify-email/resend", handlers.Repo.ResendVerificationEmail)
+
+	mux.With(middlewares.RateLimit(10, time.Hour)).Post("/email/confirm", handlers.Repo.ConfirmEmailChange)
+	mux.With(middlewares.RateLimit(10, time.Hour)).Post("/account/restore", handlers.Repo.RestoreAccount)
 
 	mux.Get("/redirect/{short}", handlers.Repo.RedirectToOriginalURL)
 	mux.Post("/redirect/{short}", handlers.Repo.CreateRedirectHistory)
+	mux.With(middlewares.RateLimit(30, time.Minute)).Post("/redirect/{short}/unlock", handlers.Repo.UnlockLink)
 
-	mux.Get("/users/{id}/history", handlers.Repo.LinksWithRedirectHistory)
+	mux.With(middlewares.RateLimit(60, time.Minute)).Get("/links/{short}/qr", handlers.Repo.LinkQRCode)
 
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(authMiddleware.RequireAuth)
 
-		mux.Get("/users/{id}", handlers.Repo.GetUserName)
-		mux.Patch("/users/{id}", handlers.Repo.UpdateUserName)
+		// Staff routes, guarded by the permissions of the caller's role
+		mux.Route("/manage", func(mux chi.Router) {
+			mux.Use(authMiddleware.RequireSession)
+
+			mux.With(authMiddleware.RequirePermission(auth.PermissionUsersRead)).Get("/users", handlers.Repo.ListUsers)
+			mux.With(authMiddleware.RequirePermission(auth.PermissionUsersRead)).Get("/users/{userID}", handlers.Repo.GetManagedUser)
+			mux.With(authMiddleware.RequirePermission(auth.PermissionRolesManage)).Put("/users/{userID}/role", handlers.Repo.UpdateUserRole)
+			mux.With(authMiddleware.RequirePermission(auth.PermissionUsersSuspend)).Post("/users/{userID}/suspend", handlers.Repo.SuspendUser)
+			mux.With(authMiddleware.RequirePermission(auth.PermissionUsersSuspend)).Post("/users/{userID}/reactivate", handlers.Repo.ReactivateUser)
+			mux.With(authMiddleware.RequirePermission(auth.PermissionUsersRead)).Get("/users/{userID}/sessions", handlers.Repo.ManagedUserSessions)
+			mux.With(authMiddleware.RequirePermission(auth.PermissionUsersSuspend)).Delete("/users/{userID}/sessions/{sid}", handlers.Repo.DeleteManagedUserSession)
+
+			mux.With(authMiddleware.RequirePermission(auth.PermissionLinksModerate)).Post("/links/{linkID}/disable", handlers.Repo.DisableLink)
+			mux.With(authMiddleware.RequirePermission(auth.PermissionLinksModerate)).Post("/links/{linkID}/enable", handlers.Repo.EnableLink)
+
+			// Runtime metrics published through expvar, e.g. the short code collision rate
+			mux.With(authMiddleware.RequirePermission(auth.PermissionMetricsRead)).Handle("/metrics", expvar.Handler())
+		})
+
+		// Routes on a user's links and history that staff who can read users
+		// may look at too
+		mux.Group(func(mux chi.Router) {
+			mux.Use(authMiddleware.RequireOwnerOr(auth.PermissionUsersRead))
+
+			mux.With(authMiddleware.RequireScope(auth.ScopeLinksRead)).Get("/users/{id}/links", handlers.Repo.AllLinks)
+			mux.With(authMiddleware.RequireScope(auth.ScopeLinksRead)).Get("/users/{id}/links/{linkID}", handlers.Repo.SingleLink)
+
+			mux.With(authMiddleware.RequireScope(auth.ScopeAnalyticsRead)).Get("/users/{id}/history", handlers.Repo.LinksWithRedirectHistory)
+		})
+
+		// Routes on a user's own resources
+		mux.Group(func(mux chi.Router) {
+			mux.Use(authMiddleware.RequireOwner)
 
-		mux.Get("/users/{id}/links", handlers.Repo.AllLinks)
-		mux.Put("/users/{id}/links/0", handlers.Repo.CreateLink)
-		mux.Get("/users/{id}/links/{linkID}", handlers.Repo.SingleLink)
-		mux.Patch("/users/{id}/links/{linkID}", handlers.Repo.UpdateLink)
-		mux.Delete("/users/{id}/links/{linkID}", handlers.Repo.DeleteLink)
+			// Routes that personal API tokens can reach with the right scope
+			mux.With(authMiddleware.RequireScope(auth.ScopeLinksWrite)).Put("/users/{id}/links/0", handlers.Repo.CreateLink)
+			mux.With(authMiddleware.RequireScope(auth.ScopeLinksWrite), middlewares.RateLimit(20, time.Hour)).Post("/users/{id}/links/bulk", handlers.Repo.BulkCreateLinks)
+			mux.With(authMiddleware.RequireScope(auth.ScopeLinksRead)).Get("/users/{id}/links/bulk/{jobID}", handlers.Repo.BulkJobStatus)
+			mux.With(authMiddleware.RequireScope(auth.ScopeLinksWrite)).Patch("/users/{id}/links/{linkID}", handlers.Repo.UpdateLink)
+			mux.With(authMiddleware.RequireScope(auth.ScopeLinksWrite)).Delete("/users/{id}/links/{linkID}", handlers.Repo.DeleteLink)
+
+			// Routes that need a logged in user
+			mux.Group(func(mux chi.Router) {
+				mux.Use(authMiddleware.RequireSession)
+
+				mux.Get("/users/{id}", handlers.Repo.GetUserName)
+				mux.Patch("/users/{id}", handlers.Repo.UpdateUserName)
+				mux.With(middlewares.RateLimit(5, time.Hour)).Delete("/users/{id}", handlers.Repo.DeleteAccount)
+				mux.With(middlewares.RateLimit(5, time.Hour)).Get("/users/{id}/export", handlers.Repo.ExportUserData)
+
+				mux.With(middlewares.RateLimit(5, time.Hour)).Patch("/users/{id}/password", handlers.Repo.ChangePassword)
+				mux.With(middlewares.RateLimit(5, time.Hour)).Post("/users/{id}/email", handlers.Repo.ChangeEmail)
+
+				mux.Get("/users/{id}/sessions", handlers.Repo.AllSessions)
+				mux.Delete("/users/{id}/sessions/{sid}", handlers.Repo.DeleteSession)
+
+				mux.Post("/users/{id}/totp/enroll", handlers.Repo.EnrollTOTP)
+				mux.Post("/users/{id}/totp/verify", handlers.Repo.VerifyTOTP)
+				mux.Post("/users/{id}/totp/disable", handlers.Repo.DisableTOTP)
+
+				mux.Get("/users/{id}/tokens", handlers.Repo.AllAPITokens)
+				mux.Post("/users/{id}/tokens", handlers.Repo.CreateAPIToken)
+				mux.Delete("/users/{id}/tokens/{tokenID}", handlers.Repo.DeleteAPIToken)
+			})
+		})
 	})
 
 	apiRouter := chi.NewRouter()
 	apiRouter.Mount("/api", mux)
 
-	return apiRouter
+	apiRouter.Get("/.well-known/jwks.json", handlers.Repo.JWKS)
+
+	if app.SHORT_DOMAIN == "" {
+		return apiRouter
+	}
+
+	// The short domain only serves the short links themselves
+	shortRouter := chi.NewRouter()
+	shortRouter.Use(middleware.Recoverer)
+
+	if app.TRUST_PROXY_HEADERS {
+		shortRouter.Use(middleware.RealIP)
+	}
+
+	shortRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, app.FRONTEND_URL, http.StatusFound)
+	})
+	shortRouter.Get("/{short}", handlers.Repo.ShortLinkRedirect)
+	shortRouter.Head("/{short}", handlers.Repo.ShortLinkRedirect)
+
+	return middlewares.Host(app.SHORT_DOMAIN, shortRouter)(apiRouter)
 }
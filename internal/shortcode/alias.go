@@ -0,0 +1,99 @@
+package shortcode
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	MinAliasLength = 3
+	MaxAliasLength = 32
+)
+
+var (
+	ErrAliasLength   = fmt.Errorf("alias must be between %d and %d characters", MinAliasLength, MaxAliasLength)
+	ErrAliasCharset  = errors.New("alias may only contain letters, digits and dashes, and must start and end with a letter or digit")
+	ErrAliasReserved = errors.New("alias is reserved")
+)
+
+// reserved holds aliases that would clash with our own paths and pages
+var reserved = map[string]bool{
+	"about": true, "account": true, "admin": true, "api": true, "app": true,
+	"assets": true, "auth": true, "billing": true, "blog": true, "contact": true,
+	"dashboard": true, "docs": true, "favicon-ico": true, "help": true, "home": true,
+	"jwks": true, "links": true, "login": true, "logout": true, "manage": true,
+	"oauth": true, "password": true, "pricing": true, "privacy": true, "qr": true,
+	"redirect": true, "refresh": true, "register": true, "reset-password": true,
+	"robots-txt": true, "settings": true, "signup": true, "static": true,
+	"status": true, "support": true, "terms": true, "unlock": true, "users": true,
+	"verify-email": true, "well-known": true, "www": true,
+}
+
+// NormalizeAlias folds an alias to lower case and checks it against the
+// alias rules. Aliases are stored folded, so "MyLink" and "mylink" are the
+// same alias.
+func NormalizeAlias(alias string) (string, error) {
+	alias = strings.ToLower(strings.TrimSpace(alias))
+
+	if len(alias) < MinAliasLength || len(alias) > MaxAliasLength {
+		return "", ErrAliasLength
+	}
+
+	for i, r := range alias {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case r == '-' && i > 0 && i < len(alias)-1 && alias[i-1] != '-':
+		default:
+			return "", ErrAliasCharset
+		}
+	}
+
+	if reserved[alias] {
+		return "", ErrAliasReserved
+	}
+
+	return alias, nil
+}
+
+// AliasCandidates returns variations of a taken alias that can be offered
+// instead. The caller still has to check which of them are free.
+func AliasCandidates(alias string, n int) []string {
+	candidates := make([]string, 0, n)
+	seen := map[string]bool{alias: true}
+
+	add := func(candidate string) {
+		if len(candidates) >= n || seen[candidate] || len(candidate) > MaxAliasLength {
+			return
+		}
+		if _, err := NormalizeAlias(candidate); err != nil {
+			return
+		}
+
+		seen[candidate] = true
+		candidates = append(candidates, candidate)
+	}
+
+	// Leave room for the suffix on long aliases
+	base := alias
+	if len(base) > MaxAliasLength-5 {
+		base = strings.TrimRight(base[:MaxAliasLength-5], "-")
+	}
+
+	for i := 1; i <= 3; i++ {
+		add(fmt.Sprintf("%s-%d", base, i))
+	}
+
+	for attempts := 0; len(candidates) < n && attempts < n*4; attempts++ {
+		suffix, err := rand.Int(rand.Reader, big.NewInt(9000))
+		if err != nil {
+			break
+		}
+
+		add(fmt.Sprintf("%s-%d", base, suffix.Int64()+1000))
+	}
+
+	return candidates
+}
@@ -0,0 +1,75 @@
+package shortcode
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// Counter turns the values of a counter into codes of a fixed length. The
+// counter is scrambled with a keyed affine permutation of the code space, so
+// consecutive links do not get consecutive codes, and two values never share
+// a code until the code space is used up.
+type Counter struct {
+	alphabet   string
+	length     int
+	space      uint64
+	multiplier uint64
+	offset     uint64
+	next       CounterFunc
+}
+
+func NewCounter(alphabet string, length int, secret string, next CounterFunc) (*Counter, error) {
+	n, ok := space(alphabet, length)
+	if !ok {
+		return nil, errors.New("short code alphabet and length are too large for counter based codes")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+
+	// Any multiplier that is coprime to the size of the space gives a permutation
+	multiplier := binary.BigEndian.Uint64(key[:8])%n | 1
+	for gcd(multiplier, n) != 1 {
+		multiplier = (multiplier + 2) % n
+	}
+
+	return &Counter{
+		alphabet:   alphabet,
+		length:     length,
+		space:      n,
+		multiplier: multiplier,
+		offset:     binary.BigEndian.Uint64(key[8:16]) % n,
+		next:       next,
+	}, nil
+}
+
+func (g *Counter) Generate() (string, error) {
+	value, err := g.next()
+	if err != nil {
+		return "", err
+	}
+	if value >= g.space {
+		return "", ErrExhausted
+	}
+
+	hi, lo := bits.Mul64(value, g.multiplier)
+	scrambled := bits.Rem64(hi, lo, g.space)
+	scrambled = (scrambled + g.offset) % g.space
+
+	code := make([]byte, g.length)
+	for i := g.length - 1; i >= 0; i-- {
+		code[i] = g.alphabet[scrambled%uint64(len(g.alphabet))]
+		scrambled /= uint64(len(g.alphabet))
+	}
+
+	return string(code), nil
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
@@ -0,0 +1,123 @@
+package shortcode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Base62 is the default alphabet of generated short codes
+const Base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	DefaultLength = 8
+	MinLength     = 4
+	MaxLength     = 32
+
+	minAlphabetSize = 16
+)
+
+// Kinds of generators that can be configured
+const (
+	KindRandom  = "random"
+	KindCounter = "counter"
+	KindHashids = "hashids"
+)
+
+var ErrExhausted = errors.New("all short codes of the configured length are used up")
+
+// Generator produces short codes for new links. Codes are not guaranteed to
+// be unique, callers have to retry when the database reports a collision.
+type Generator interface {
+	Generate() (string, error)
+}
+
+// CounterFunc returns the next value of a counter that is shared by every
+// instance of the service, e.g. a database sequence
+type CounterFunc func() (uint64, error)
+
+// Options configure a generator. Secret keys the counter and hashids
+// generators, so that their codes cannot be predicted from each other.
+type Options struct {
+	Kind     string
+	Length   int
+	Alphabet string
+	Secret   string
+	Counter  CounterFunc
+}
+
+// New builds the generator described by opts
+func New(opts Options) (Generator, error) {
+	if opts.Length == 0 {
+		opts.Length = DefaultLength
+	}
+	if opts.Alphabet == "" {
+		opts.Alphabet = Base62
+	}
+
+	if opts.Length < MinLength || opts.Length > MaxLength {
+		return nil, fmt.Errorf("short code length must be between %d and %d", MinLength, MaxLength)
+	}
+
+	err := validateAlphabet(opts.Alphabet)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Kind {
+	case "", KindRandom:
+		return NewRandom(opts.Alphabet, opts.Length), nil
+	case KindCounter, KindHashids:
+		if opts.Counter == nil {
+			return nil, fmt.Errorf("%s short codes need a counter", opts.Kind)
+		}
+		if opts.Secret == "" {
+			return nil, fmt.Errorf("%s short codes need a secret", opts.Kind)
+		}
+
+		if opts.Kind == KindCounter {
+			return NewCounter(opts.Alphabet, opts.Length, opts.Secret, opts.Counter)
+		}
+
+		return NewHashids(opts.Alphabet, opts.Length, opts.Secret, opts.Counter), nil
+	}
+
+	return nil, fmt.Errorf("unknown short code generator %q", opts.Kind)
+}
+
+// validateAlphabet only accepts letters and digits, which is what the
+// redirect endpoint accepts in generated codes
+func validateAlphabet(alphabet string) error {
+	if len(alphabet) < minAlphabetSize {
+		return fmt.Errorf("short code alphabet must have at least %d characters", minAlphabetSize)
+	}
+
+	seen := make(map[byte]bool, len(alphabet))
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return errors.New("short code alphabet may only contain letters and digits")
+		}
+		if seen[c] {
+			return fmt.Errorf("short code alphabet repeats %q", c)
+		}
+
+		seen[c] = true
+	}
+
+	return nil
+}
+
+// space returns len(alphabet)^length, or false if it does not fit in an int64
+func space(alphabet string, length int) (uint64, bool) {
+	n := uint64(1)
+	for i := 0; i < length; i++ {
+		if n > math.MaxInt64/uint64(len(alphabet)) {
+			return 0, false
+		}
+
+		n *= uint64(len(alphabet))
+	}
+
+	return n, true
+}
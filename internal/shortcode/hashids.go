@@ -0,0 +1,74 @@
+package shortcode
+
+// Hashids encodes the values of a counter the way hashids does: the alphabet
+// is shuffled with a salt, and again for every value with a "lottery"
+// character that starts the code. Codes are padded to the configured length
+// and grow beyond it once the counter needs more characters.
+type Hashids struct {
+	alphabet []byte
+	salt     []byte
+	length   int
+	next     CounterFunc
+}
+
+func NewHashids(alphabet string, length int, salt string, next CounterFunc) *Hashids {
+	return &Hashids{
+		alphabet: shuffle([]byte(alphabet), []byte(salt)),
+		salt:     []byte(salt),
+		length:   length,
+		next:     next,
+	}
+}
+
+func (g *Hashids) Generate() (string, error) {
+	value, err := g.next()
+	if err != nil {
+		return "", err
+	}
+
+	return g.encode(value), nil
+}
+
+func (g *Hashids) encode(value uint64) string {
+	size := uint64(len(g.alphabet))
+	lottery := g.alphabet[value%size]
+
+	// Digits are written with a fixed width, and every position is read with
+	// its own alphabet, which follows from the lottery character
+	alphabet := append([]byte(nil), g.alphabet...)
+	key := append([]byte{lottery}, g.salt...)
+
+	var digits []byte
+	for value > 0 || len(digits) < g.length-1 {
+		alphabet = shuffle(alphabet, append(key, alphabet...)[:len(alphabet)])
+
+		digits = append(digits, alphabet[value%size])
+		value /= size
+	}
+
+	code := make([]byte, 0, len(digits)+1)
+	code = append(code, lottery)
+	for i := len(digits) - 1; i >= 0; i-- {
+		code = append(code, digits[i])
+	}
+
+	return string(code)
+}
+
+// shuffle is the consistent shuffle of hashids, it reorders alphabet in place
+// depending on salt
+func shuffle(alphabet, salt []byte) []byte {
+	if len(salt) == 0 {
+		return alphabet
+	}
+
+	for i, v, p := len(alphabet)-1, 0, 0; i > 0; i, v = i-1, v+1 {
+		v %= len(salt)
+		p += int(salt[v])
+		j := (int(salt[v]) + v + p) % i
+
+		alphabet[i], alphabet[j] = alphabet[j], alphabet[i]
+	}
+
+	return alphabet
+}
@@ -0,0 +1,29 @@
+package shortcode
+
+import "expvar"
+
+// Collision metrics, published through expvar
+var (
+	insertAttempts = expvar.NewInt("shortcode_insert_attempts")
+	collisions     = expvar.NewInt("shortcode_collisions")
+)
+
+func init() {
+	expvar.Publish("shortcode_collision_rate", expvar.Func(func() interface{} {
+		attempts := insertAttempts.Value()
+		if attempts == 0 {
+			return 0.0
+		}
+
+		return float64(collisions.Value()) / float64(attempts)
+	}))
+}
+
+// RecordInsert counts an attempt to insert a link with a generated code and
+// whether the code was already taken
+func RecordInsert(collided bool) {
+	insertAttempts.Add(1)
+	if collided {
+		collisions.Add(1)
+	}
+}
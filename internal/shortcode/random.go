@@ -0,0 +1,42 @@
+package shortcode
+
+import "crypto/rand"
+
+// Random generates codes from a cryptographically secure random source
+type Random struct {
+	alphabet string
+	length   int
+}
+
+func NewRandom(alphabet string, length int) *Random {
+	return &Random{alphabet: alphabet, length: length}
+}
+
+func (g *Random) Generate() (string, error) {
+	code := make([]byte, 0, g.length)
+
+	// Bytes at or above limit are dropped, so that every character of the
+	// alphabet is equally likely
+	limit := 256 - 256%len(g.alphabet)
+
+	buf := make([]byte, g.length*2)
+	for len(code) < g.length {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+
+			code = append(code, g.alphabet[int(b)%len(g.alphabet)])
+			if len(code) == g.length {
+				break
+			}
+		}
+	}
+
+	return string(code), nil
+}
@@ -1,9 +1,14 @@
 package utils
 
 import (
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
-	"math/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
 	"net/mail"
+	"net/url"
 	"regexp"
 )
 
@@ -18,6 +23,18 @@ func IsValidEmail(email string) bool {
 	return false
 }
 
+// IsValidLinkURL reports whether a link may redirect to rawURL. Only absolute
+// http and https urls are accepted, anything else, such as javascript: urls or
+// relative paths that would resolve against our own domain, is refused.
+func IsValidLinkURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
 func GetIDFromURL(urlPath string) (string, string) {
 	var userID string
 	var linkID string
@@ -40,20 +57,31 @@ func GetIDFromURL(urlPath string) (string, string) {
 	return userID, linkID
 }
 
-func GenerateRandomHash(length int) (string, error) {
-	byteLength := (length * 6) / 8
-	if (length*6)%8 != 0 {
-		byteLength++
-	}
-
-	randomBytes := make([]byte, byteLength)
-	_, err := rand.Read(randomBytes)
+// GenerateSecureToken returns a URL-safe token built from n bytes of
+// cryptographically secure randomness
+func GenerateSecureToken(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	_, err := crand.Read(randomBytes)
 	if err != nil {
 		return "", err
 	}
 
-	randomString := base64.URLEncoding.EncodeToString(randomBytes)
-	randomString = randomString[:length]
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// HashToken returns the hex encoded SHA-256 digest of a token so that it can
+// be stored and looked up without keeping the plain text value
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIP returns the address of the client that sent the request
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
 
-	return randomString, nil
+	return host
 }
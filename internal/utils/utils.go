@@ -68,3 +68,27 @@ func ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
 
 	return WriteJSON(w, statusCode, payload)
 }
+
+// FieldError describes why the value of a single request field was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FieldErrorsJSON writes an error response that lists every rejected field
+// under data.fields, so that the frontend can show them next to the inputs
+func FieldErrorsJSON(w http.ResponseWriter, fieldErrors []FieldError, status ...int) error {
+	statusCode := http.StatusBadRequest
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload JSONResponse
+	payload.Error = true
+	payload.Message = fieldErrors[0].Message
+	payload.Data = map[string]interface{}{"fields": fieldErrors}
+
+	return WriteJSON(w, statusCode, payload)
+}